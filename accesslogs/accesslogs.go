@@ -0,0 +1,353 @@
+// Package accesslogs configures load balancers to deliver their access logs
+// to an S3 bucket, so that they can then be ingested.
+package accesslogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/honeycombio/honeyelb/iampolicy"
+)
+
+const (
+	policyVersion = "2012-10-17"
+
+	// Sid of the bucket policy statement which allows Elastic Load
+	// Balancing to write access logs. Used to detect whether the statement
+	// has already been added.
+	policyStatementID = "HoneyELBAccessLogDelivery"
+
+	// How often (in minutes) classic load balancers should publish access
+	// logs. Application load balancers always publish every 5 minutes.
+	classicEmitInterval = 5
+)
+
+// elbAccountIDs are the AWS accounts which Elastic Load Balancing writes
+// access logs from, by region. The bucket policy must allow the account for
+// the load balancer's region to put objects.
+//
+// http://docs.aws.amazon.com/elasticloadbalancing/latest/classic/enable-access-logs.html#attach-bucket-policy
+var elbAccountIDs = map[string]string{
+	"us-east-1":      "127311923021",
+	"us-east-2":      "033677994240",
+	"us-west-1":      "027434742980",
+	"us-west-2":      "797873946194",
+	"ca-central-1":   "985666609251",
+	"eu-central-1":   "054676820928",
+	"eu-west-1":      "156460612806",
+	"eu-west-2":      "652711504416",
+	"eu-west-3":      "009996457667",
+	"eu-north-1":     "897822967062",
+	"ap-northeast-1": "582318560864",
+	"ap-northeast-2": "600734575887",
+	"ap-northeast-3": "383597477331",
+	"ap-southeast-1": "114774131450",
+	"ap-southeast-2": "783225319266",
+	"ap-south-1":     "718504428378",
+	"sa-east-1":      "507241528517",
+	"us-gov-west-1":  "048591011584",
+	"cn-north-1":     "638102146993",
+}
+
+// Enabler turns on access logging for load balancers, creating the bucket and
+// bucket policy they need along the way.
+type Enabler struct {
+	Bucket string
+	Prefix string
+
+	// If set, the planned changes are written to Out but not made.
+	DryRun bool
+
+	// Where to report changes (or planned changes) to.
+	Out io.Writer
+
+	sess      *session.Session
+	region    string
+	accountID string
+}
+
+func NewEnabler(sess *session.Session, bucket, prefix string, dryRun bool, out io.Writer) *Enabler {
+	return &Enabler{
+		Bucket: bucket,
+		Prefix: strings.Trim(prefix, "/"),
+		DryRun: dryRun,
+		Out:    out,
+		sess:   sess,
+		region: aws.StringValue(sess.Config.Region),
+	}
+}
+
+func (e *Enabler) report(format string, args ...interface{}) {
+	if e.DryRun {
+		format = "[dry-run] Would " + format
+	}
+	fmt.Fprintf(e.Out, format+"\n", args...)
+}
+
+// Enable configures the bucket, then every one of the named load balancers.
+func (e *Enabler) Enable(lbNames []string) error {
+	userResp, err := sts.New(e.sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("Error trying to get account ID: %s", err)
+	}
+	e.accountID = aws.StringValue(userResp.Account)
+
+	if err := e.ensureBucket(); err != nil {
+		return err
+	}
+
+	if err := e.ensureBucketPolicy(); err != nil {
+		return err
+	}
+
+	for _, lbName := range lbNames {
+		if err := e.enableLB(lbName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Enabler) ensureBucket() error {
+	s3Svc := s3.New(e.sess)
+
+	_, err := s3Svc.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(e.Bucket),
+	})
+	if err == nil {
+		locResp, err := s3Svc.GetBucketLocation(&s3.GetBucketLocationInput{
+			Bucket: aws.String(e.Bucket),
+		})
+		if err != nil {
+			return fmt.Errorf("Error getting location of bucket %q: %s", e.Bucket, err)
+		}
+
+		bucketRegion := s3.NormalizeBucketLocation(aws.StringValue(locResp.LocationConstraint))
+		if bucketRegion != e.region {
+			return fmt.Errorf("Bucket %q is in region %s, but load balancers can only deliver access logs to a bucket in the same region (%s)", e.Bucket, bucketRegion, e.region)
+		}
+
+		fmt.Fprintf(e.Out, "Using existing bucket %q in %s\n", e.Bucket, bucketRegion)
+		return nil
+	}
+
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
+		return fmt.Errorf("Error checking bucket %q: %s", e.Bucket, err)
+	}
+
+	e.report("create bucket %q in %s", e.Bucket, e.region)
+	if e.DryRun {
+		return nil
+	}
+
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(e.Bucket),
+	}
+	// us-east-1 is the default, and is rejected if specified explicitly.
+	if e.region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(e.region),
+		}
+	}
+	if _, err := s3Svc.CreateBucket(input); err != nil {
+		return fmt.Errorf("Error creating bucket %q: %s", e.Bucket, err)
+	}
+
+	return nil
+}
+
+// policyStatement builds the bucket policy statement which allows the
+// regional Elastic Load Balancing account to write our account's access logs.
+func (e *Enabler) policyStatement() (map[string]interface{}, error) {
+	elbAccountID, ok := elbAccountIDs[e.region]
+	if !ok {
+		return nil, fmt.Errorf("Don't know the Elastic Load Balancing account for region %q", e.region)
+	}
+
+	logPath := "AWSLogs/" + e.accountID + "/*"
+	if e.Prefix != "" {
+		logPath = e.Prefix + "/" + logPath
+	}
+
+	arnPartition := iampolicy.Partition(e.region)
+
+	return map[string]interface{}{
+		"Sid":    policyStatementID,
+		"Effect": "Allow",
+		"Principal": map[string]string{
+			"AWS": "arn:" + arnPartition + ":iam::" + elbAccountID + ":root",
+		},
+		"Action":   "s3:PutObject",
+		"Resource": "arn:" + arnPartition + ":s3:::" + e.Bucket + "/" + logPath,
+	}, nil
+}
+
+// mergePolicy adds the statement to the existing bucket policy (if any),
+// replacing any statement we added previously (e.g., for a different prefix)
+// and leaving everything else in the policy alone.
+func mergePolicy(existing string, statement map[string]interface{}) (map[string]interface{}, error) {
+	policy := map[string]interface{}{"Version": policyVersion}
+	if existing != "" {
+		if err := json.Unmarshal([]byte(existing), &policy); err != nil {
+			return nil, err
+		}
+	}
+
+	// Statement may be a single statement rather than a list of them.
+	var existingStatements []interface{}
+	switch s := policy["Statement"].(type) {
+	case nil:
+	case []interface{}:
+		existingStatements = s
+	case map[string]interface{}:
+		existingStatements = []interface{}{s}
+	default:
+		return nil, fmt.Errorf("Statement is neither a statement nor a list of them")
+	}
+
+	statements := []interface{}{}
+	for _, s := range existingStatements {
+		if m, ok := s.(map[string]interface{}); ok && m["Sid"] == policyStatementID {
+			continue
+		}
+		statements = append(statements, s)
+	}
+	policy["Statement"] = append(statements, statement)
+
+	return policy, nil
+}
+
+func (e *Enabler) ensureBucketPolicy() error {
+	s3Svc := s3.New(e.sess)
+
+	statement, err := e.policyStatement()
+	if err != nil {
+		return err
+	}
+
+	existing := ""
+	policyResp, err := s3Svc.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: aws.String(e.Bucket),
+	})
+	if err == nil {
+		existing = aws.StringValue(policyResp.Policy)
+	} else {
+		// No policy yet is fine, as is no bucket yet when we didn't
+		// actually create it due to a dry run.
+		aerr, ok := err.(awserr.Error)
+		noPolicy := ok && (aerr.Code() == "NoSuchBucketPolicy" ||
+			(e.DryRun && aerr.Code() == s3.ErrCodeNoSuchBucket))
+		if !noPolicy {
+			return fmt.Errorf("Error getting policy of bucket %q: %s", e.Bucket, err)
+		}
+	}
+
+	policy, err := mergePolicy(existing, statement)
+	if err != nil {
+		return fmt.Errorf("Error parsing existing policy of bucket %q: %s", e.Bucket, err)
+	}
+
+	policyJSON, err := json.MarshalIndent(policy, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+
+	e.report("set policy of bucket %q to:\n%s", e.Bucket, policyJSON)
+	if e.DryRun {
+		return nil
+	}
+
+	if _, err := s3Svc.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(e.Bucket),
+		Policy: aws.String(string(policyJSON)),
+	}); err != nil {
+		return fmt.Errorf("Error setting policy of bucket %q: %s", e.Bucket, err)
+	}
+
+	return nil
+}
+
+// enableLB turns on access logging for a classic load balancer, or for an
+// application load balancer if there is no classic one with that name.
+func (e *Enabler) enableLB(lbName string) error {
+	elbSvc := elb.New(e.sess)
+
+	_, err := elbSvc.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String(lbName)},
+	})
+	if err == nil {
+		return e.enableClassicLB(elbSvc, lbName)
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != elb.ErrCodeAccessPointNotFoundException {
+		return fmt.Errorf("Error describing LB %q: %s", lbName, err)
+	}
+
+	elbv2Svc := elbv2.New(e.sess)
+
+	describeResp, err := elbv2Svc.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		Names: []*string{aws.String(lbName)},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == elbv2.ErrCodeLoadBalancerNotFoundException {
+			return fmt.Errorf("No load balancer named %q was found", lbName)
+		}
+		return fmt.Errorf("Error describing LB %q: %s", lbName, err)
+	}
+
+	return e.enableV2LB(elbv2Svc, lbName, aws.StringValue(describeResp.LoadBalancers[0].LoadBalancerArn))
+}
+
+func (e *Enabler) enableClassicLB(elbSvc *elb.ELB, lbName string) error {
+	e.report("enable access logs for classic load balancer %q, delivering to s3://%s/%s every %d minutes",
+		lbName, e.Bucket, e.Prefix, classicEmitInterval)
+	if e.DryRun {
+		return nil
+	}
+
+	if _, err := elbSvc.ModifyLoadBalancerAttributes(&elb.ModifyLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(lbName),
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			AccessLog: &elb.AccessLog{
+				Enabled:        aws.Bool(true),
+				S3BucketName:   aws.String(e.Bucket),
+				S3BucketPrefix: aws.String(e.Prefix),
+				EmitInterval:   aws.Int64(classicEmitInterval),
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("Error enabling access logs for LB %q: %s", lbName, err)
+	}
+
+	return nil
+}
+
+func (e *Enabler) enableV2LB(elbv2Svc *elbv2.ELBV2, lbName, lbARN string) error {
+	e.report("enable access logs for application load balancer %q, delivering to s3://%s/%s",
+		lbName, e.Bucket, e.Prefix)
+	if e.DryRun {
+		return nil
+	}
+
+	if _, err := elbv2Svc.ModifyLoadBalancerAttributes(&elbv2.ModifyLoadBalancerAttributesInput{
+		LoadBalancerArn: aws.String(lbARN),
+		Attributes: []*elbv2.LoadBalancerAttribute{
+			{Key: aws.String("access_logs.s3.enabled"), Value: aws.String("true")},
+			{Key: aws.String("access_logs.s3.bucket"), Value: aws.String(e.Bucket)},
+			{Key: aws.String("access_logs.s3.prefix"), Value: aws.String(e.Prefix)},
+		},
+	}); err != nil {
+		return fmt.Errorf("Error enabling access logs for LB %q: %s", lbName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package accesslogs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergePolicy(t *testing.T) {
+	ours := map[string]interface{}{"Sid": policyStatementID, "Action": "s3:PutObject"}
+	theirs := map[string]interface{}{"Sid": "Theirs", "Action": "s3:GetObject"}
+
+	tests := []struct {
+		name     string
+		existing string
+		want     map[string]interface{}
+	}{
+		{
+			name:     "no policy",
+			existing: "",
+			want: map[string]interface{}{
+				"Version":   policyVersion,
+				"Statement": []interface{}{ours},
+			},
+		},
+		{
+			name:     "single statement",
+			existing: `{"Version": "2012-10-17", "Id": "Policy1", "Statement": {"Sid": "Theirs", "Action": "s3:GetObject"}}`,
+			want: map[string]interface{}{
+				"Version":   policyVersion,
+				"Id":        "Policy1",
+				"Statement": []interface{}{theirs, ours},
+			},
+		},
+		{
+			name:     "replaces ours",
+			existing: `{"Version": "2012-10-17", "Statement": [{"Sid": "Theirs", "Action": "s3:GetObject"}, {"Sid": "HoneyELBAccessLogDelivery", "Action": "s3:Old"}]}`,
+			want: map[string]interface{}{
+				"Version":   policyVersion,
+				"Statement": []interface{}{theirs, ours},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := mergePolicy(test.existing, ours)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if _, err := mergePolicy(`{"Statement": "nonsense"}`, ours); err == nil {
+		t.Errorf("no error for a Statement which is a string")
+	}
+}
@@ -0,0 +1,180 @@
+package discovery
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/facebookgo/limitgroup"
+)
+
+const (
+	// How many DescribeLoadBalancerAttributes calls may be in flight at
+	// once. Kept fairly low since the ELB API rate limits are shared with
+	// everything else in the account.
+	maxConcurrentDescribes = 8
+
+	// How many times a throttled call is retried before giving up, and the
+	// initial delay between attempts (doubled on every retry).
+	maxThrottleRetries     = 6
+	initialThrottleBackoff = 500 * time.Millisecond
+)
+
+// LoadBalancer is the subset of a load balancer's description and attributes
+// which we need in order to find (and ingest) its access logs.
+type LoadBalancer struct {
+	Name             string
+	AccessLogEnabled bool
+	BucketName       string
+	BucketPrefix     string
+
+	// How often access logs are published, either 5 or 60 minutes.
+	EmitInterval time.Duration
+}
+
+// withBackoff calls fn until it succeeds, fails with an error which is not
+// due to throttling, or runs out of retries.
+func withBackoff(op string, fn func() error) error {
+	backoff := initialThrottleBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !request.IsErrorThrottle(err) || attempt == maxThrottleRetries {
+			return err
+		}
+
+		// Add up to 50% jitter so concurrent callers don't retry in
+		// lockstep.
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff/2)))
+		logrus.WithFields(logrus.Fields{
+			"op":      op,
+			"attempt": attempt + 1,
+			"wait":    wait,
+		}).Debug("Request throttled, backing off")
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// LoadBalancerNames returns the names of all of the load balancers visible to
+// the provided ELB client, following pagination markers as needed.
+func LoadBalancerNames(elbSvc *elb.ELB) ([]string, error) {
+	names := []string{}
+	input := &elb.DescribeLoadBalancersInput{}
+
+	for {
+		var page *elb.DescribeLoadBalancersOutput
+		err := withBackoff("DescribeLoadBalancers", func() error {
+			var err error
+			page, err = elbSvc.DescribeLoadBalancers(input)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error describing LBs: %s", err)
+		}
+
+		for _, lb := range page.LoadBalancerDescriptions {
+			names = append(names, *lb.LoadBalancerName)
+		}
+
+		if aws.StringValue(page.NextMarker) == "" {
+			return names, nil
+		}
+		input.Marker = page.NextMarker
+	}
+}
+
+// DescribeAttributes looks up the access log configuration of a single load
+// balancer.
+func DescribeAttributes(elbSvc *elb.ELB, name string) (LoadBalancer, error) {
+	lb := LoadBalancer{Name: name}
+
+	var lbResp *elb.DescribeLoadBalancerAttributesOutput
+	err := withBackoff("DescribeLoadBalancerAttributes", func() error {
+		var err error
+		lbResp, err = elbSvc.DescribeLoadBalancerAttributes(&elb.DescribeLoadBalancerAttributesInput{
+			LoadBalancerName: aws.String(name),
+		})
+		return err
+	})
+	if err != nil {
+		return lb, err
+	}
+
+	if accessLog := lbResp.LoadBalancerAttributes.AccessLog; accessLog != nil {
+		lb.AccessLogEnabled = aws.BoolValue(accessLog.Enabled)
+		lb.BucketName = aws.StringValue(accessLog.S3BucketName)
+		lb.BucketPrefix = aws.StringValue(accessLog.S3BucketPrefix)
+		lb.EmitInterval = time.Duration(aws.Int64Value(accessLog.EmitInterval)) * time.Minute
+	}
+
+	return lb, nil
+}
+
+// Describe looks up the access log configuration of the load balancers with
+// the given names, or of every load balancer if no names are provided. Names
+// which do not (or no longer) exist are warned about and left out of the
+// result rather than treated as an error, so callers can detect removed load
+// balancers.
+//
+// Load balancers whose attributes could not be described are logged and
+// returned in skipped instead, so that a single failure does not prevent the
+// rest from being ingested.
+func Describe(elbSvc *elb.ELB, names []string) (lbs []LoadBalancer, skipped []string, err error) {
+	existing, err := LoadBalancerNames(elbSvc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(names) > 0 {
+		wanted := make(map[string]bool, len(names))
+		for _, name := range names {
+			wanted[name] = true
+		}
+		filtered := []string{}
+		for _, name := range existing {
+			if wanted[name] {
+				filtered = append(filtered, name)
+				delete(wanted, name)
+			}
+		}
+		existing = filtered
+
+		for _, name := range names {
+			if wanted[name] {
+				logrus.WithField("lbName", name).Warn("Load balancer not found, check that its name and region are right")
+				delete(wanted, name)
+			}
+		}
+	}
+
+	results := make([]LoadBalancer, len(existing))
+	errs := make([]error, len(existing))
+	lg := limitgroup.NewLimitGroup(maxConcurrentDescribes)
+	for i, name := range existing {
+		lg.Add(1)
+		go func(i int, name string) {
+			defer lg.Done()
+			results[i], errs[i] = DescribeAttributes(elbSvc, name)
+		}(i, name)
+	}
+	lg.Wait()
+
+	lbs = []LoadBalancer{}
+	for i, lb := range results {
+		if errs[i] != nil {
+			logrus.WithFields(logrus.Fields{
+				"lbName": lb.Name,
+				"error":  errs[i],
+			}).Error("Error describing load balancer attributes, skipping")
+			skipped = append(skipped, lb.Name)
+			continue
+		}
+		lbs = append(lbs, lb)
+	}
+
+	return lbs, skipped, nil
+}
@@ -0,0 +1,320 @@
+// Package doctor runs preflight checks of the configuration honeyelb needs to
+// ingest access logs, so that problems surface up front (with a hint on how to
+// fix them) instead of partway through ingestion.
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/honeycombio/honeyelb/discovery"
+	"github.com/honeycombio/honeyelb/logbucket"
+	"github.com/honeycombio/honeyelb/options"
+)
+
+const enableLogsHint = "run 'honeyelb --bucket=<bucket> enable-logs <lb>' or see http://docs.aws.amazon.com/elasticloadbalancing/latest/classic/enable-access-logs.html"
+
+// Result is the outcome of a single check.
+type Result struct {
+	Check  string
+	Err    error
+	Detail string
+
+	// Hint describes how to fix the problem when the check fails.
+	Hint string
+}
+
+// Passed reports whether the check succeeded.
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+type doctor struct {
+	sess      *session.Session
+	opt       *options.Options
+	accountID string
+	region    string
+	results   []Result
+}
+
+func (d *doctor) record(check, detail string, err error, hint string) {
+	d.results = append(d.results, Result{
+		Check:  check,
+		Err:    err,
+		Detail: detail,
+		Hint:   hint,
+	})
+}
+
+// Run performs every check against the named load balancers (or all of them
+// if none are named) and returns the results in the order they were run.
+// Checks which depend on an earlier one that failed are skipped.
+func Run(sess *session.Session, opt *options.Options, lbNames []string) []Result {
+	d := &doctor{
+		sess:   sess,
+		opt:    opt,
+		region: aws.StringValue(sess.Config.Region),
+	}
+
+	d.checkStateDir()
+	d.checkWriteKeys()
+
+	if d.checkCredentials() {
+		d.checkLoadBalancers(lbNames)
+	}
+
+	return d.results
+}
+
+func (d *doctor) checkCredentials() bool {
+	userResp, err := sts.New(d.sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		d.record("AWS credentials (sts:GetCallerIdentity)", "", err,
+			"provide credentials via the environment, ~/.aws/credentials or an instance role, and allow sts:GetCallerIdentity")
+		return false
+	}
+
+	d.accountID = aws.StringValue(userResp.Account)
+	d.record("AWS credentials (sts:GetCallerIdentity)", aws.StringValue(userResp.Arn), nil, "")
+
+	if d.region == "" {
+		d.record("AWS region", "", fmt.Errorf("no region configured"),
+			"set AWS_REGION or a region in ~/.aws/config")
+		return false
+	}
+	d.record("AWS region", d.region, nil, "")
+
+	return true
+}
+
+func (d *doctor) checkLoadBalancers(lbNames []string) {
+	elbSvc := elb.New(d.sess)
+
+	existing, err := discovery.LoadBalancerNames(elbSvc)
+	if err != nil {
+		d.record("List load balancers (elasticloadbalancing:DescribeLoadBalancers)", "", err,
+			"allow elasticloadbalancing:DescribeLoadBalancers, see policy.json")
+		return
+	}
+	d.record("List load balancers (elasticloadbalancing:DescribeLoadBalancers)",
+		fmt.Sprintf("%d found", len(existing)), nil, "")
+
+	if len(lbNames) == 0 {
+		lbNames = existing
+	}
+
+	found := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		found[name] = true
+	}
+
+	// Only check each bucket's region once, even if shared by several LBs.
+	checkedBuckets := make(map[string]bool)
+
+	for _, name := range lbNames {
+		check := fmt.Sprintf("LB %s access logs (elasticloadbalancing:DescribeLoadBalancerAttributes)", name)
+
+		if !found[name] {
+			d.record(check, "", fmt.Errorf("no classic load balancer named %q", name),
+				"check the name with 'honeyelb ls', and that the region is correct")
+			continue
+		}
+
+		lb, err := discovery.DescribeAttributes(elbSvc, name)
+		if err != nil {
+			d.record(check, "", err, "allow elasticloadbalancing:DescribeLoadBalancerAttributes, see policy.json")
+			continue
+		}
+		if !lb.AccessLogEnabled {
+			d.record(check, "", fmt.Errorf("access logs are disabled"), enableLogsHint)
+			continue
+		}
+		d.record(check, "s3://"+lb.BucketName+"/"+lb.BucketPrefix, nil, "")
+
+		bucketOK, checked := checkedBuckets[lb.BucketName]
+		if !checked {
+			bucketOK = d.checkBucketRegion(lb.BucketName)
+			checkedBuckets[lb.BucketName] = bucketOK
+		}
+		if bucketOK {
+			d.checkObjects(lb)
+		}
+	}
+}
+
+func (d *doctor) checkBucketRegion(bucketName string) bool {
+	check := fmt.Sprintf("Bucket %s region (s3:GetBucketLocation)", bucketName)
+	locResp, err := s3.New(d.sess).GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		d.record(check, "", err, "allow s3:GetBucketLocation on the bucket, see policy.json")
+		return false
+	}
+	bucketRegion := s3.NormalizeBucketLocation(aws.StringValue(locResp.LocationConstraint))
+	if bucketRegion != d.region {
+		d.record(check, bucketRegion, fmt.Errorf("bucket is in %s, not %s", bucketRegion, d.region),
+			"run honeyelb with AWS_REGION set to the load balancer's region")
+		return false
+	}
+	d.record(check, bucketRegion, nil, "")
+
+	return true
+}
+
+// checkObjects lists (and reads) objects the same way ingestion will.
+func (d *doctor) checkObjects(lb discovery.LoadBalancer) {
+	s3Svc := s3.New(d.sess)
+
+	downloadParser := logbucket.ObjectDownloadParser{
+		Service: logbucket.AWSElasticLoadBalancing,
+		Entity:  lb.Name,
+	}
+	prefix := downloadParser.TotalPrefix(lb.BucketPrefix, d.accountID, d.region)
+
+	check := fmt.Sprintf("LB %s list objects (s3:ListBucket)", lb.Name)
+	listResp, err := s3Svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(lb.BucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		d.record(check, "", err, "allow s3:ListBucket on the bucket, see policy.json")
+		return
+	}
+	if len(listResp.Contents) == 0 {
+		d.record(check, "no access logs delivered yet today under "+prefix, nil, "")
+		return
+	}
+	d.record(check, prefix, nil, "")
+
+	check = fmt.Sprintf("LB %s read objects (s3:GetObject)", lb.Name)
+	if _, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(lb.BucketName),
+		Key:    listResp.Contents[0].Key,
+	}); err != nil {
+		d.record(check, "", err, "allow s3:GetObject on the bucket's objects, see policy.json")
+		return
+	}
+	d.record(check, aws.StringValue(listResp.Contents[0].Key), nil, "")
+}
+
+func (d *doctor) checkStateDir() {
+	check := "State directory " + d.opt.StateDir
+	hint := "create the directory given by --statedir and make it writable by the honeyelb user"
+
+	info, err := os.Stat(d.opt.StateDir)
+	if err != nil {
+		d.record(check, "", err, hint)
+		return
+	}
+	if !info.IsDir() {
+		d.record(check, "", fmt.Errorf("not a directory"), hint)
+		return
+	}
+
+	f, err := ioutil.TempFile(d.opt.StateDir, "honeyelb-doctor")
+	if err != nil {
+		d.record(check, "", fmt.Errorf("not writable: %s", err), hint)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	d.record(check, "exists and is writable", nil, "")
+}
+
+// checkWriteKeys checks the global write key, and those of any targets which
+// send to a different Honeycomb team.
+func (d *doctor) checkWriteKeys() {
+	type team struct{ writeKey, apiHost string }
+	checked := make(map[team]bool)
+
+	if d.opt.WriteKey == "" && len(d.opt.Targets) == 0 {
+		d.record("Honeycomb write key", "", fmt.Errorf("no write key set"),
+			"set --writekey to the write key at https://ui.honeycomb.io/account")
+		return
+	}
+	if d.opt.WriteKey != "" {
+		d.checkWriteKey("Honeycomb write key", d.opt.WriteKey, d.opt.APIHost)
+		checked[team{d.opt.WriteKey, d.opt.APIHost}] = true
+	}
+
+	for _, name := range d.opt.TargetNames() {
+		target := d.opt.Target(name)
+		t := team{target.WriteKey, target.APIHost}
+		if checked[t] {
+			continue
+		}
+		checked[t] = true
+
+		check := fmt.Sprintf("Honeycomb write key for %s", name)
+		if target.WriteKey == "" {
+			d.record(check, "", fmt.Errorf("no write key set"),
+				"set --writekey, or a writekey for the target in the config file")
+			continue
+		}
+		d.checkWriteKey(check, target.WriteKey, target.APIHost)
+	}
+}
+
+func (d *doctor) checkWriteKey(check, writeKey, apiHost string) {
+	hint := "check the write key against the one at https://ui.honeycomb.io/account"
+
+	req, err := http.NewRequest("GET", strings.TrimRight(apiHost, "/")+"/1/auth", nil)
+	if err != nil {
+		d.record(check, "", err, "check --api_host")
+		return
+	}
+	req.Header.Set("X-Honeycomb-Team", writeKey)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		d.record(check, "", err, "check that "+apiHost+" is reachable from this host")
+		return
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		d.record(check, "", fmt.Errorf("write key was rejected"), hint)
+	case resp.StatusCode != http.StatusOK:
+		d.record(check, "", fmt.Errorf("unexpected response from Honeycomb API: %s", resp.Status),
+			"check --api_host and try again later")
+	default:
+		d.record(check, "accepted by "+apiHost, nil, "")
+	}
+}
+
+// PrintTable writes the results as a table to w and reports whether every
+// check passed.
+func PrintTable(w io.Writer, results []Result) bool {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+
+	allPassed := true
+	for _, r := range results {
+		if r.Passed() {
+			fmt.Fprintf(tw, "%s\tPASS\t%s\n", r.Check, r.Detail)
+			continue
+		}
+		allPassed = false
+		fmt.Fprintf(tw, "%s\tFAIL\t%s\n", r.Check, r.Err)
+		fmt.Fprintf(tw, "\t\thint: %s\n", r.Hint)
+	}
+	tw.Flush()
+
+	return allPassed
+}
@@ -0,0 +1,132 @@
+// Package iampolicy generates the least-privilege IAM policy needed to ingest
+// the access logs of a particular set of load balancers.
+package iampolicy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/honeycombio/honeyelb/discovery"
+	"github.com/honeycombio/honeyelb/logbucket"
+)
+
+const policyVersion = "2012-10-17"
+
+type Statement struct {
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string][]string `json:",omitempty"`
+}
+
+type Document struct {
+	Version   string
+	Statement []Statement
+}
+
+// Partition returns the ARN partition for the region, e.g., "aws-cn" for the
+// China regions.
+func Partition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	default:
+		return "aws"
+	}
+}
+
+// Generate builds a policy which allows exactly the API calls honeyelb makes
+// when ingesting (and running doctor against) the given load balancers'
+// access logs. Ingest state is kept on local disk, so needs no permissions.
+func Generate(accountID, region string, lbs []discovery.LoadBalancer) Document {
+	s3ARN := "arn:" + Partition(region) + ":s3:::"
+
+	doc := Document{
+		Version: policyVersion,
+		Statement: []Statement{
+			// Describe calls don't support resource-level
+			// permissions, so these can't be scoped further.
+			{
+				Effect: "Allow",
+				Action: []string{
+					"elasticloadbalancing:DescribeLoadBalancerAttributes",
+					"elasticloadbalancing:DescribeLoadBalancers",
+				},
+				Resource: []string{"*"},
+			},
+			// Used to get the account ID, which is part of the
+			// access log object keys.
+			{
+				Effect:   "Allow",
+				Action:   []string{"sts:GetCallerIdentity"},
+				Resource: []string{"*"},
+			},
+		},
+	}
+
+	// Object key patterns of each LB's access logs, by bucket.
+	bucketPatterns := make(map[string][]string)
+	for _, lb := range lbs {
+		if !lb.AccessLogEnabled {
+			continue
+		}
+		downloadParser := logbucket.ObjectDownloadParser{
+			Service: logbucket.AWSElasticLoadBalancing,
+			Entity:  lb.Name,
+		}
+		pattern := downloadParser.DayPrefix(lb.BucketPrefix, accountID, region, "*")
+		bucketPatterns[lb.BucketName] = append(bucketPatterns[lb.BucketName], pattern)
+	}
+
+	buckets := []string{}
+	for bucket := range bucketPatterns {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	bucketResources := []string{}
+	objectResources := []string{}
+	for _, bucket := range buckets {
+		patterns := bucketPatterns[bucket]
+		sort.Strings(patterns)
+
+		bucketResources = append(bucketResources, s3ARN+bucket)
+		for _, pattern := range patterns {
+			// The LB name is followed by the timestamp, so the "_" stops
+			// this from also matching LBs whose names start with this one.
+			objectResources = append(objectResources, s3ARN+bucket+"/"+pattern+"_*")
+		}
+
+		// The list prefix is a condition rather than a resource, so
+		// each bucket needs its own statement.
+		doc.Statement = append(doc.Statement, Statement{
+			Effect:   "Allow",
+			Action:   []string{"s3:ListBucket"},
+			Resource: []string{s3ARN + bucket},
+			Condition: map[string]map[string][]string{
+				"StringLike": {"s3:prefix": patterns},
+			},
+		})
+	}
+
+	if len(buckets) > 0 {
+		doc.Statement = append(doc.Statement,
+			Statement{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObject"},
+				Resource: objectResources,
+			},
+			// Only used by doctor, to check the bucket is in the
+			// same region as the load balancers.
+			Statement{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetBucketLocation"},
+				Resource: bucketResources,
+			},
+		)
+	}
+
+	return doc
+}
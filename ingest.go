@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/honeycombio/honeyelb/discovery"
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeyelb/publisher"
+	"github.com/honeycombio/honeyelb/statedir"
+	flag "github.com/jessevdk/go-flags"
+)
+
+// How often to check whether the config file has changed, with --watch-config.
+const configWatchInterval = 10 * time.Second
+
+// ingestLBNames returns the names of the load balancers to ingest: those named
+// on the command line, else those with targets in the config file. Empty means
+// all of them.
+func ingestLBNames(args []string, opt *options.Options) []string {
+	if len(args) > 0 {
+		return args
+	}
+	return opt.TargetNames()
+}
+
+// requestReload asks for the config to be reloaded, unless a reload is already
+// pending.
+func requestReload(reloadCh chan<- struct{}) {
+	select {
+	case reloadCh <- struct{}{}:
+	default:
+	}
+}
+
+// watchConfigFile signals on reloadCh whenever the config file's modification
+// time changes.
+func watchConfigFile(path string, reloadCh chan<- struct{}) {
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for range time.Tick(configWatchInterval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			logrus.WithError(err).Debug("Error checking config file for changes")
+			continue
+		}
+		if info.ModTime() != lastModified {
+			lastModified = info.ModTime()
+			requestReload(reloadCh)
+		}
+	}
+}
+
+func cmdIngest(sess *session.Session, elbSvc *elb.ELB, args []string) error {
+	// Targets in the config file may carry their own write keys instead.
+	if opt.WriteKey == "" && len(opt.Targets) == 0 {
+		logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
+Your write key is available at https://ui.honeycomb.io/account`)
+	}
+
+	// Keep 'honeyelb replay' from updating the state files while they are
+	// in use.
+	unlock, err := statedir.Lock(opt.StateDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	publisher.InitTransmission()
+	if err := publisher.InitGeoIP(opt.GeoIPDB, opt.ASNDB, opt.GeoIPCacheSize); err != nil {
+		return err
+	}
+
+	lbNames := ingestLBNames(args, opt)
+
+	lbs, skipped, err := discovery.Describe(elbSvc, lbNames)
+	if err != nil {
+		return err
+	}
+
+	running := newIngesters(sess, opt)
+	running.sync(lbs, skipped)
+
+	// Periodically re-discover load balancers so that new (or removed)
+	// ones are picked up without a restart.
+	discoveryTicker := time.NewTicker(opt.DiscoveryInterval)
+	defer discoveryTicker.Stop()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+
+	reloadCh := make(chan struct{}, 1)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			requestReload(reloadCh)
+		}
+	}()
+	if opt.WatchConfig && opt.ConfigFile != "" {
+		go watchConfigFile(opt.ConfigFile, reloadCh)
+	}
+
+	// block forever (until interrupt)
+	for {
+		select {
+		case <-reloadCh:
+			logrus.Info("Reloading config")
+			newOpt, newArgs, err := parseOptions(flag.None)
+			if err != nil {
+				logrus.WithError(err).Error("Error reloading config, keeping the current one")
+				continue
+			}
+
+			if newOpt.StateDir != opt.StateDir {
+				newUnlock, err := statedir.Lock(newOpt.StateDir)
+				if err != nil {
+					logrus.WithError(err).Error("Error reloading config, keeping the current one")
+					continue
+				}
+				unlock()
+				unlock = newUnlock
+			}
+
+			if newOpt.DiscoveryInterval != opt.DiscoveryInterval {
+				discoveryTicker.Stop()
+				discoveryTicker = time.NewTicker(newOpt.DiscoveryInterval)
+			}
+
+			opt = newOpt
+			lbNames = ingestLBNames(newArgs[1:], opt)
+			running.reconfigure(opt)
+
+			// Pick up load balancers which have been added to (or
+			// removed from) the config straight away.
+			lbs, skipped, err := discovery.Describe(elbSvc, lbNames)
+			if err != nil {
+				logrus.WithError(err).Error("Error re-discovering load balancers")
+				continue
+			}
+			running.sync(lbs, skipped)
+
+		case <-discoveryTicker.C:
+			lbs, skipped, err := discovery.Describe(elbSvc, lbNames)
+			if err != nil {
+				logrus.WithError(err).Error("Error re-discovering load balancers")
+				continue
+			}
+			running.sync(lbs, skipped)
+
+		case <-signalCh:
+			logrus.Info("Exiting due to interrupt.")
+			// Wait for the objects in flight to finish, so that
+			// their state and the samplers' state are saved.
+			//
+			// TODO(nathanleclaire): Delete format file, even
+			// though it's in /tmp.
+			running.stopAll()
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/honeycombio/honeyelb/discovery"
+	"github.com/honeycombio/honeyelb/logbucket"
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeyelb/publisher"
+)
+
+const accessLogsDisabledMsg = `Access logs are not configured for this ELB. Please enable them to ingest its logs.
+
+For reference see this link:
+
+http://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html#enable-access-logging`
+
+// ingester is a running ingest goroutine for a single load balancer.
+type ingester struct {
+	lb        discovery.LoadBalancer
+	target    options.Target
+	publisher *publisher.HoneycombPublisher
+	cancel    context.CancelFunc
+
+	// Closed once the ingest goroutine has returned.
+	done chan struct{}
+}
+
+// ingesters keeps track of which load balancers are being ingested, so that
+// ingestion can be started and stopped as load balancers come and go.
+type ingesters struct {
+	sess *session.Session
+	opt  *options.Options
+
+	// The most recently discovered state of each load balancer, used to
+	// log changes between discovery runs.
+	known   map[string]discovery.LoadBalancer
+	running map[string]*ingester
+}
+
+func newIngesters(sess *session.Session, opt *options.Options) *ingesters {
+	return &ingesters{
+		sess:    sess,
+		opt:     opt,
+		known:   make(map[string]discovery.LoadBalancer),
+		running: make(map[string]*ingester),
+	}
+}
+
+// sync starts ingestion for load balancers which are new or have had access
+// logs enabled, and stops it for those which are gone or have had access logs
+// disabled. Load balancers whose access log settings have changed are
+// restarted. Load balancers which could not be described this time around are
+// left as they were.
+func (i *ingesters) sync(lbs []discovery.LoadBalancer, skipped []string) {
+	seen := make(map[string]bool, len(lbs)+len(skipped))
+	for _, name := range skipped {
+		seen[name] = true
+	}
+
+	for _, lb := range lbs {
+		seen[lb.Name] = true
+		i.logChange(lb)
+		i.known[lb.Name] = lb
+
+		running, isRunning := i.running[lb.Name]
+		switch {
+		case !lb.AccessLogEnabled:
+			if isRunning {
+				i.stop(lb.Name)
+			}
+		case !isRunning:
+			i.start(lb)
+		case running.lb != lb:
+			i.stop(lb.Name)
+			i.start(lb)
+		}
+	}
+
+	for name := range i.known {
+		if !seen[name] {
+			logrus.WithField("lbName", name).Info("Load balancer no longer exists or is no longer selected for ingestion")
+			delete(i.known, name)
+			if _, isRunning := i.running[name]; isRunning {
+				i.stop(name)
+			}
+		}
+	}
+}
+
+func (i *ingesters) logChange(lb discovery.LoadBalancer) {
+	logger := logrus.WithField("lbName", lb.Name)
+	prev, wasKnown := i.known[lb.Name]
+
+	switch {
+	case !wasKnown:
+		logger.Info("Discovered load balancer")
+	case prev.AccessLogEnabled && !lb.AccessLogEnabled:
+		logger.Info("Access logs have been disabled for load balancer")
+	case !prev.AccessLogEnabled && lb.AccessLogEnabled:
+		logger.Info("Access logs have been enabled for load balancer")
+	case prev.BucketName == lb.BucketName && prev.BucketPrefix == lb.BucketPrefix && prev != lb:
+		logger.WithField("emitInterval", lb.EmitInterval).Info("Access log emit interval has changed for load balancer")
+	case prev != lb:
+		logger.WithFields(logrus.Fields{
+			"bucket": lb.BucketName,
+			"prefix": lb.BucketPrefix,
+		}).Info("Access log location has changed for load balancer")
+	}
+
+	if !lb.AccessLogEnabled && (!wasKnown || prev.AccessLogEnabled) {
+		logger.Warn(accessLogsDisabledMsg)
+	}
+}
+
+func (i *ingesters) start(lb discovery.LoadBalancer) {
+	target := i.opt.Target(lb.Name)
+	if target.WriteKey == "" {
+		logrus.WithField("lbName", lb.Name).Error("No write key set for load balancer, set --writekey or a writekey for its target in the config file")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"bucket":  lb.BucketName,
+		"lbName":  lb.Name,
+		"dataset": target.Dataset,
+	}).Info("Access logs are enabled for ELB ♥")
+
+	hp := publisher.NewHoneycombPublisher(i.opt, target, publisher.AWSElasticLoadBalancerFormat)
+
+	// In adaptive mode, polls are timed around when the load balancer
+	// publishes its access logs.
+	var emitInterval time.Duration
+	if i.opt.AdaptivePoll {
+		emitInterval = lb.EmitInterval
+	}
+
+	downloadParser := logbucket.ObjectDownloadParser{
+		Service:            logbucket.AWSElasticLoadBalancing,
+		Entity:             lb.Name,
+		HoneycombPublisher: hp,
+		StateDir:           i.opt.StateDir,
+		BackfillInterval:   target.Backfill,
+		UseTempFiles:       i.opt.TempFiles,
+		NewestFirst:        i.opt.Order == "newest-first",
+		PollInterval:       i.opt.PollInterval,
+		EmitInterval:       emitInterval,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &ingester{
+		lb:        lb,
+		target:    target,
+		publisher: hp,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	i.running[lb.Name] = running
+
+	// TODO: One-goroutine-per-LB is a bit silly.
+	//
+	// Finish implementing a proper 'pipeline'
+	// instead using channels:
+	//
+	// (Query Objects to Process) => (Download Objects) => (Parse Objects) => (Send to HC)
+	go func() {
+		defer close(running.done)
+		downloadParser.Ingest(ctx, i.sess, lb.BucketName, lb.BucketPrefix)
+	}()
+}
+
+// stop stops ingestion for the load balancer, waiting for the object in
+// flight (if any) to finish so that its state is saved.
+func (i *ingesters) stop(name string) {
+	logrus.WithField("lbName", name).Info("Stopping ingestion for load balancer")
+	running := i.running[name]
+	running.cancel()
+	<-running.done
+	if err := running.publisher.SaveSamplerState(); err != nil {
+		logrus.WithError(err).WithField("lbName", name).Warn("Error saving sampler state")
+	}
+	running.publisher.Stop()
+	delete(i.running, name)
+}
+
+// stopAll stops ingestion for every load balancer.
+func (i *ingesters) stopAll() {
+	for name := range i.running {
+		i.stop(name)
+	}
+}
+
+// reconfigure applies new options to the running ingesters. Changes to a
+// load balancer's dataset, write key, sample rate or transforms are applied to
+// its publisher in place. Changes to where or how far back its objects are
+// looked for restart it, which picks up where it left off from its state.
+// Load balancers which are no longer selected are stopped by the next sync.
+func (i *ingesters) reconfigure(opt *options.Options) {
+	prevOpt := i.opt
+	i.opt = opt
+
+	for name, running := range i.running {
+		target := opt.Target(name)
+		logger := logrus.WithField("lbName", name)
+
+		switch {
+		case target.WriteKey == "":
+			logger.Error("No write key set for load balancer any more")
+			i.stop(name)
+		case opt.StateDir != prevOpt.StateDir || opt.TempFiles != prevOpt.TempFiles ||
+			opt.Order != prevOpt.Order || opt.PollInterval != prevOpt.PollInterval ||
+			opt.AdaptivePoll != prevOpt.AdaptivePoll || target.Backfill != running.target.Backfill:
+			logger.Info("Restarting ingestion to apply new config")
+			i.stop(name)
+			i.start(running.lb)
+		case !reflect.DeepEqual(target, running.target):
+			logger.WithFields(logrus.Fields{
+				"dataset":    target.Dataset,
+				"samplerate": target.SampleRate,
+			}).Info("Applying new config")
+			running.publisher.Update(target)
+			running.target = target
+		}
+	}
+}
@@ -1,11 +1,12 @@
 package logbucket
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -20,21 +21,21 @@ import (
 )
 
 const (
-	// Somewhat arbitrary -- usually we see about 50 objects per hour in
-	// Honeycomb dogfood data.
-	//
-	// Important thing is that the length is capped and does not grow
-	// indefinitely, old objects will not need de-dupe protection as they
-	// will not be returned in the list objects results once an hour has
-	// elapsed.
-	maxProcessedObjects = 2000
+	// How long after the end of an emit interval its access logs are
+	// expected to have been published, and the most jitter to add on top
+	// when scheduling polls for them.
+	publishDelay  = 2 * time.Minute
+	maxPollJitter = time.Minute
+
+	// The listing cursor is kept this far behind the end of the newest
+	// interval, since each load balancer node delivers its objects at a
+	// different time and those delivered late must still be listed.
+	cursorLag = 10 * time.Minute
 
 	AWSElasticLoadBalancing     = "elasticloadbalancing"
 	AWSApplicationLoadBalancing = "elasticloadbalancingv2"
 	AWSCloudFront               = ""
 	AWSCloudTrail               = "CloudTrail"
-
-	stateFileFormat = "%s-state-%s.json"
 )
 
 type ObjectDownloadParser struct {
@@ -55,9 +56,28 @@ type ObjectDownloadParser struct {
 	// The directory in which to store files indicating the current state
 	// of which objects have been processed.
 	StateDir string
+
+	// How far back to look for objects to process, relative to when they
+	// were last modified.
+	BackfillInterval time.Duration
+
+	// Whether to download each object to a temporary file before parsing
+	// it, rather than parsing it as it streams in.
+	UseTempFiles bool
+
+	// Whether to process the newest objects first, rather than the oldest.
+	NewestFirst bool
+
+	// How often to poll for new objects.
+	PollInterval time.Duration
+
+	// How often the entity publishes objects. If set, polls are scheduled
+	// just after each is expected to be published, instead of every
+	// PollInterval.
+	EmitInterval time.Duration
 }
 
-//TODO: write test and maybe return error also?
+// TODO: write test and maybe return error also?
 func userIDFromARN(arn string) string {
 	splitARN := strings.Split(arn, ":")
 	return splitARN[4]
@@ -69,46 +89,42 @@ func (o *ObjectDownloadParser) parseEvents(log string) error {
 	if err != nil {
 		return err
 	}
+	defer logFile.Close()
+
+	return o.publish(logFile)
+}
+
+func (o *ObjectDownloadParser) publish(r io.Reader) error {
+	r, err := decompress(r)
+	if err != nil {
+		return err
+	}
 
 	// Publish will perform the scanning and send the events to Honeycomb.
-	return o.Publish(logFile)
+	return o.Publish(r)
 }
 
 func (o *ObjectDownloadParser) processObject(sess *session.Session, bucketName string, obj *s3.Object) error {
-	// Backfill one hour backwards by default
-	//
-	// TODO(nathanleclaire): Make backfill interval configurable.
-	if time.Since(*obj.LastModified) < time.Hour {
-		objectRecord := strings.Replace(*obj.Key, "/", "_", -1)
-
-		stateFile := filepath.Join(o.StateDir, fmt.Sprintf(stateFileFormat, o.Service, o.Entity))
-
-		if _, err := os.Stat(stateFile); os.IsNotExist(err) {
-			// make sure file exists first run
-			if err := ioutil.WriteFile(stateFile, []byte(`[]`), 0644); err != nil {
-				return fmt.Errorf("Error writing file: %s", err)
-			}
-		}
-
+	if time.Since(*obj.LastModified) < o.BackfillInterval {
 		// Accessing this file is safe, since we use
 		// 1-goroutine-per-entity, therefore only one goroutine will be
 		// in this critical section (per file) at a time.
-		data, err := ioutil.ReadFile(stateFile)
+		state, err := o.loadState()
 		if err != nil {
-			return fmt.Errorf("Error reading object cursor file: %s", err)
+			return err
 		}
 
-		var processedObjects []string
-
-		if err := json.Unmarshal(data, &processedObjects); err != nil {
-			return fmt.Errorf("Unmarshalling state file JSON failed: %s", err)
+		if state.isProcessed(*obj.Key) {
+			// Objects after the listing cursor are listed by
+			// every poll until it moves past them.
+			logrus.WithField("object", objectRecord(*obj.Key)).Debug("Already processed object, skipping.")
+			return nil
 		}
 
-		for _, obj := range processedObjects {
-			if obj == objectRecord {
-				logrus.WithField("object", obj).Info("Already processed object, skipping.")
-				return nil
-			}
+		// Objects which have failed before are retried on their own
+		// schedule, by retryFailed.
+		if _, failed := state.Failed[*obj.Key]; failed {
+			return nil
 		}
 
 		logrus.WithFields(logrus.Fields{
@@ -118,140 +134,387 @@ func (o *ObjectDownloadParser) processObject(sess *session.Session, bucketName s
 			"entity":        o.Entity,
 		}).Info("Downloading access logs from object")
 
-		f, err := ioutil.TempFile("", "hc-entity-ingest")
-		if err != nil {
-			return fmt.Errorf("Error creating tmp file: %s", err)
-		}
+		return o.ingestObject(sess, state, bucketName, *obj.Key)
+	}
 
-		downloader := s3manager.NewDownloader(sess)
+	return nil
+}
 
-		nBytes, err := downloader.Download(f, &s3.GetObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(*obj.Key),
-		})
-		if err != nil {
-			return fmt.Errorf("Error downloading object file: %s", err)
+// ingestObject downloads and publishes the object, then records whether it
+// succeeded or failed in the state.
+func (o *ObjectDownloadParser) ingestObject(sess *session.Session, state *ingestState, bucketName, key string) error {
+	if err := o.downloadAndPublish(sess, bucketName, key); err != nil {
+		failure := state.recordFailure(bucketName, key, err)
+		if saveErr := o.saveState(state); saveErr != nil {
+			return saveErr
 		}
-
-		if err := f.Close(); err != nil {
-			return fmt.Errorf("Error closing downloaded object file: %s", err)
+		if failure.Attempts >= maxObjectAttempts {
+			return fmt.Errorf("%s (giving up after %d attempts, use 'honeyelb replay' to try again)", err, failure.Attempts)
 		}
+		return err
+	}
 
-		logrus.WithFields(logrus.Fields{
-			"bytes":  nBytes,
-			"file":   f.Name(),
-			"entity": o.Entity,
-		}).Info("Successfully downloaded object")
+	state.markProcessed(key)
+	return o.saveState(state)
+}
 
-		if err := o.parseEvents(f.Name()); err != nil {
-			return fmt.Errorf("Error parsing access log file: %s", err)
-		}
+func (o *ObjectDownloadParser) downloadAndPublish(sess *session.Session, bucketName, key string) error {
+	if o.UseTempFiles {
+		return o.downloadToTempFile(sess, bucketName, key)
+	}
 
-		processedObjects = append(processedObjects, objectRecord)
+	body, err := newObjectReader(s3.New(sess), bucketName, key)
+	if err != nil {
+		return fmt.Errorf("Error downloading object file: %s", err)
+	}
+	defer body.Close()
 
-		if len(processedObjects) > maxProcessedObjects {
-			// "rotate" oldest remembered object out so state file
-			// does not grow indefinitely
-			processedObjects = processedObjects[1:]
+	// If any events couldn't be sent, the object isn't recorded as
+	// processed, so that it is tried again.
+	if err := o.publish(body); err != nil {
+		return fmt.Errorf("Error parsing access log object: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"bytes":  body.offset,
+		"entity": o.Entity,
+	}).Info("Successfully streamed object")
+
+	return nil
+}
+
+func (o *ObjectDownloadParser) downloadToTempFile(sess *session.Session, bucketName, key string) error {
+	f, err := ioutil.TempFile("", "hc-entity-ingest")
+	if err != nil {
+		return fmt.Errorf("Error creating tmp file: %s", err)
+	}
+
+	// Clean up the downloaded object, however far we got with it.
+	defer os.Remove(f.Name())
+
+	downloader := s3manager.NewDownloader(sess)
+
+	nBytes, err := downloader.Download(f, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Error downloading object file: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error closing downloaded object file: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"bytes":  nBytes,
+		"file":   f.Name(),
+		"entity": o.Entity,
+	}).Info("Successfully downloaded object")
+
+	// If any events couldn't be sent, the object isn't recorded as
+	// processed, so that it is tried again.
+	if err := o.parseEvents(f.Name()); err != nil {
+		return fmt.Errorf("Error parsing access log file: %s", err)
+	}
+
+	return nil
+}
+
+// retryFailed retries the objects which have failed before and are due
+// another attempt. Those which have used up their attempts are left for
+// Replay.
+func (o *ObjectDownloadParser) retryFailed(ctx context.Context, sess *session.Session) {
+	state, err := o.loadState()
+	if err != nil {
+		logrus.WithError(err).Error("Error loading state to retry failed objects")
+		return
+	}
+
+	now := time.Now()
+	for _, failure := range state.failures() {
+		if ctx.Err() != nil {
+			return
+		}
+		if failure.Attempts >= maxObjectAttempts || now.Before(failure.NextAttempt) {
+			continue
 		}
 
-		processedData, err := json.Marshal(processedObjects)
-		if err != nil {
-			return fmt.Errorf("Marshalling JSON failed: %s", err)
+		logrus.WithFields(logrus.Fields{
+			"key":      failure.Key,
+			"attempts": failure.Attempts,
+			"entity":   o.Entity,
+		}).Info("Retrying failed object")
+
+		if err := o.ingestObject(sess, state, failure.Bucket, failure.Key); err != nil {
+			logrus.WithError(err).Error("Error processing bucket object")
 		}
+	}
+}
 
-		if err := ioutil.WriteFile(stateFile, processedData, 0644); err != nil {
-			return fmt.Errorf("Writing file failed: %s", err)
+// Replay tries every failed object again straight away, including those which
+// have used up their attempts, and returns how many still failed.
+func (o *ObjectDownloadParser) Replay(ctx context.Context, sess *session.Session) (int, error) {
+	state, err := o.loadState()
+	if err != nil {
+		return 0, err
+	}
+
+	stillFailed := 0
+	for _, failure := range state.failures() {
+		if ctx.Err() != nil {
+			return stillFailed, ctx.Err()
 		}
 
-		// Clean up the downloaded object.
-		if err := os.Remove(f.Name()); err != nil {
-			return fmt.Errorf("Error cleaning up downloaded object %s: %s", f.Name(), err)
+		logrus.WithFields(logrus.Fields{
+			"key":      failure.Key,
+			"attempts": failure.Attempts,
+			"error":    failure.Error,
+			"entity":   o.Entity,
+		}).Info("Replaying failed object")
+
+		if err := o.ingestObject(sess, state, failure.Bucket, failure.Key); err != nil {
+			logrus.WithError(err).Error("Error processing bucket object")
+			stillFailed++
 		}
 	}
 
-	return nil
+	return stillFailed, nil
 }
 
-func (o *ObjectDownloadParser) accessLogBucketPageCallback(sess *session.Session, bucketName string, bucketResp *s3.ListObjectsOutput, lastPage bool) bool {
+func (o *ObjectDownloadParser) accessLogBucketPageCallback(bucketName string, objects *[]*s3.Object, bucketResp *s3.ListObjectsV2Output, lastPage bool) bool {
 	logrus.WithFields(logrus.Fields{
 		"bucket_name": bucketName,
 		"num_objects": len(bucketResp.Contents),
 	}).Debug("Executing bucket callback")
 
-	// TODO: This sort doesn't work as originally intended if the paging
-	// comes into play. Consider removing, or gathering all desired objects
-	// as a result of the callback, _then_ sorting and iterating over them.
-	sort.Slice(bucketResp.Contents, func(i, j int) bool {
-		return (*bucketResp.Contents[i].LastModified).After(
-			*bucketResp.Contents[j].LastModified,
-		)
+	// Objects are only gathered here, so that they can be ordered across
+	// all pages before any are processed.
+	*objects = append(*objects, bucketResp.Contents...)
+
+	return !lastPage
+}
+
+// keyTime returns the end of the interval an access log object covers, from
+// the timestamp in its key, e.g., "20140215T2340Z" in
+// ".../123456789012_elasticloadbalancing_us-west-2_my-loadbalancer_20140215T2340Z_172.160.001.192_20sg8hgm.log".
+// Objects whose keys don't have one fall back to when they were last modified.
+func keyTime(obj *s3.Object) time.Time {
+	base := (*obj.Key)[strings.LastIndex(*obj.Key, "/")+1:]
+	for _, part := range strings.Split(base, "_") {
+		if t, err := time.Parse("20060102T1504Z", part); err == nil {
+			return t
+		}
+	}
+	return *obj.LastModified
+}
+
+// sortObjects orders objects by the time they cover, oldest first unless
+// NewestFirst is set. Objects covering the same time keep their key order.
+func (o *ObjectDownloadParser) sortObjects(objects []*s3.Object) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		ti, tj := keyTime(objects[i]), keyTime(objects[j])
+		if o.NewestFirst {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
 	})
+}
+
+// processObjects processes the objects listed under the prefix in time order,
+// then moves the listing cursor past those which have been dealt with and
+// can't be followed by any late ones.
+func (o *ObjectDownloadParser) processObjects(ctx context.Context, sess *session.Session, bucketName, prefix string, objects []*s3.Object) {
+	if len(objects) == 0 {
+		return
+	}
+
+	// Listing returns keys in order, which sorting is about to change.
+	listed := make([]*s3.Object, len(objects))
+	copy(listed, objects)
 
-	for _, obj := range bucketResp.Contents {
+	o.sortObjects(objects)
+
+	handled := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		// Finish the object in flight, but don't start any new ones
+		// once we have been asked to stop.
+		if ctx.Err() != nil {
+			break
+		}
 		if err := o.processObject(sess, bucketName, obj); err != nil {
 			logrus.WithError(err).Error("Error processing bucket object")
 		}
+		// Failed objects are recorded in the state, to be retried,
+		// so they count as dealt with too.
+		handled[*obj.Key] = true
 	}
 
-	return !lastPage
+	cursor := newCursor(listed, handled, time.Now())
+	if cursor == "" {
+		return
+	}
+	if err := o.advanceCursor(prefix, cursor); err != nil {
+		logrus.WithError(err).Error("Error saving listing cursor")
+	}
 }
 
-func (o *ObjectDownloadParser) TotalPrefix(bucketPrefix, accountID, region string) string {
+// newCursor returns the last of the objects, in the order they were listed,
+// which the listing cursor can move past: those which have been handled, with
+// nothing left unhandled before them, and whose interval ended at least
+// cursorLag ago. Objects after the cursor are listed again, and the ones
+// already processed are skipped. It returns "" if the cursor can't move.
+func newCursor(listed []*s3.Object, handled map[string]bool, now time.Time) string {
+	cursor := ""
+	for _, obj := range listed {
+		if !handled[*obj.Key] || now.Sub(keyTime(obj)) < cursorLag {
+			break
+		}
+		cursor = *obj.Key
+	}
+	return cursor
+}
+
+// advanceCursor records that every object under the prefix up to and
+// including key has been dealt with, so that it isn't listed again.
+func (o *ObjectDownloadParser) advanceCursor(prefix, key string) error {
+	state, err := o.loadState()
+	if err != nil {
+		return err
+	}
+	state.setCursor(prefix, key)
+	return o.saveState(state)
+}
+
+// nextPollWait returns how long to wait before polling again. With an emit
+// interval, that's until the objects for the next interval to end should
+// have been published, plus some jitter so that load balancers with the same
+// interval aren't all polled at once.
+func (o *ObjectDownloadParser) nextPollWait(now time.Time) time.Duration {
+	if o.EmitInterval <= 0 {
+		return o.PollInterval
+	}
+
+	// Intervals are aligned to the hour, e.g., :00, :05, :10 for 5 minute
+	// intervals.
+	nextPublish := now.Truncate(o.EmitInterval).Add(publishDelay)
+	if !nextPublish.After(now) {
+		nextPublish = nextPublish.Add(o.EmitInterval)
+	}
+	jitter := time.Duration(rand.Int63n(int64(maxPollJitter)))
+	return nextPublish.Add(jitter).Sub(now)
+}
+
+// DayPrefix returns the prefix of the entity's objects for the given day, in
+// the form "2006/01/02". Passing "*" instead of a day gives a pattern matching
+// the entity's objects for any day, e.g., for use in IAM policies.
+func (o *ObjectDownloadParser) DayPrefix(bucketPrefix, accountID, region, day string) string {
 	if bucketPrefix != "" {
 		// Add seperator slash so concatenation makes sense.
 		bucketPrefix += "/"
 	}
 
+	return bucketPrefix + "AWSLogs/" + accountID + "/" + o.Service + "/" + region + "/" + day +
+		"/" + accountID + "_" + o.Service + "_" + region + "_" + o.Entity
+}
+
+func (o *ObjectDownloadParser) TotalPrefix(bucketPrefix, accountID, region string) string {
 	// Converted into a string which also is used for the object prefix
-	nowPath := time.Now().UTC().Format("/2006/01/02")
+	nowPath := time.Now().UTC().Format("2006/01/02")
 
 	// For now, get objects for just today.
-	return bucketPrefix + "AWSLogs/" + accountID + "/" + o.Service + "/" + region + nowPath +
-		"/" + accountID + "_" + o.Service + "_" + region + "_" + o.Entity
+	return o.DayPrefix(bucketPrefix, accountID, region, nowPath)
 }
 
-func (o *ObjectDownloadParser) Ingest(sess *session.Session, bucketName, bucketPrefix string) {
-	// used to get account ID (needed to know the
-	// bucket's object prefix)
-	stsClient := sts.New(sess)
-	req, userResp := stsClient.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
-	if err := req.Send(); err != nil {
-		fmt.Fprintln(os.Stderr, "Error trying to get account ID: ", err)
-		os.Exit(1)
-	}
-
-	accountID := userIDFromARN(*userResp.Arn)
+// Ingest polls the bucket for new access log objects and processes them until
+// the context is cancelled. Errors getting the account ID or listing the bucket
+// are logged and tried again at the next poll, so that one load balancer's
+// problems don't stop the others from being ingested.
+func (o *ObjectDownloadParser) Ingest(ctx context.Context, sess *session.Session, bucketName, bucketPrefix string) {
+	accountID := ""
 	region := *sess.Config.Region
 
-	// get new logs every 5 minutes
-	ticker := time.NewTicker(5 * time.Minute).C
 	// Start the loop to continually ingest access logs.
 	for {
-		s3svc := s3.New(sess, nil)
+		if accountID == "" {
+			// used to get account ID (needed to know the
+			// bucket's object prefix)
+			stsClient := sts.New(sess)
+			req, userResp := stsClient.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+			if err := req.Send(); err != nil {
+				logrus.WithError(err).WithField("entity", o.Entity).Error("Error trying to get account ID")
+			} else {
+				accountID = userIDFromARN(*userResp.Arn)
+			}
+		}
 
-		totalPrefix := o.TotalPrefix(bucketPrefix, accountID, region)
+		if accountID != "" {
+			o.poll(ctx, sess, bucketName, bucketPrefix, accountID, region)
+		}
 
+		wait := o.nextPollWait(time.Now())
 		logrus.WithFields(logrus.Fields{
-			"prefix": totalPrefix,
 			"entity": o.Entity,
-		}).Info("Getting recent objects")
-
-		// Wrapper function used to satisfy the method signature of
-		// ListObjectsPages and still pass additional parameters like
-		// sess.
-		cb := func(bucketResp *s3.ListObjectsOutput, lastPage bool) bool {
-			return o.accessLogBucketPageCallback(sess, bucketName, bucketResp, lastPage)
+			"wait":   wait,
+		}).Info("Pausing until the next set of logs are available")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			logrus.WithField("entity", o.Entity).Info("Stopped ingesting")
+			return
 		}
+	}
+}
 
-		if err := s3svc.ListObjectsPages(&s3.ListObjectsInput{
-			Bucket: aws.String(bucketName),
-			Prefix: aws.String(totalPrefix),
-		}, cb); err != nil {
-			fmt.Fprintln(os.Stderr, "Error listing/paging bucket objects: ", err)
-			os.Exit(1)
-		}
-		logrus.Info("Pausing until the next set of logs are available")
-		<-ticker
+// poll lists the objects which are new since the last poll and processes
+// them, then retries any failed objects which are due and snapshots the
+// sampler.
+func (o *ObjectDownloadParser) poll(ctx context.Context, sess *session.Session, bucketName, bucketPrefix, accountID, region string) {
+	s3svc := s3.New(sess, nil)
+
+	totalPrefix := o.TotalPrefix(bucketPrefix, accountID, region)
+
+	logrus.WithFields(logrus.Fields{
+		"prefix": totalPrefix,
+		"entity": o.Entity,
+	}).Info("Getting recent objects")
+
+	// Wrapper function used to satisfy the method signature of
+	// ListObjectsV2Pages and still pass additional parameters.
+	objects := []*s3.Object{}
+	cb := func(bucketResp *s3.ListObjectsV2Output, lastPage bool) bool {
+		return o.accessLogBucketPageCallback(bucketName, &objects, bucketResp, lastPage)
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(totalPrefix),
+	}
+
+	// Keys are ordered by time, so only those after the last one
+	// dealt with need listing.
+	if state, err := o.loadState(); err != nil {
+		logrus.WithError(err).Error("Error loading listing cursor, listing all of today's objects")
+	} else if startAfter := state.cursor(totalPrefix); startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+
+	if err := s3svc.ListObjectsV2Pages(input, cb); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"bucket_name": bucketName,
+			"entity":      o.Entity,
+		}).Error("Error listing/paging bucket objects, will try again next poll")
+	} else {
+		o.processObjects(ctx, sess, bucketName, totalPrefix, objects)
+	}
+	o.retryFailed(ctx, sess)
+
+	// Only ingest snapshots its sampler, so that 'honeyelb replay' doesn't
+	// overwrite the snapshot with its own.
+	if err := o.SaveSamplerState(); err != nil {
+		logrus.WithError(err).WithField("entity", o.Entity).Warn("Error saving sampler state")
 	}
 }
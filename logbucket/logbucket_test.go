@@ -0,0 +1,177 @@
+package logbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testKeyPrefix = "AWSLogs/123456789012/elasticloadbalancing/us-west-2/2014/02/15/123456789012_elasticloadbalancing_us-west-2_my-loadbalancer_"
+
+// testObject returns an access log object covering the interval ending at
+// the time ("20140215T2340Z") from the node with the IP.
+func testObject(t, ip string, lastModified time.Time) *s3.Object {
+	return &s3.Object{
+		Key:          aws.String(testKeyPrefix + t + "_" + ip + "_20sg8hgm.log"),
+		LastModified: aws.Time(lastModified),
+	}
+}
+
+func TestNewCursor(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("20060102T1504Z", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name    string
+		listed  []*s3.Object
+		handled []int
+		now     time.Time
+		want    int // index into listed, or -1 for no cursor
+	}{
+		{
+			name: "newest interval too recent",
+			listed: []*s3.Object{
+				testObject("20140215T1005Z", "10.0.0.1", at("20140215T1006Z")),
+				testObject("20140215T1005Z", "172.16.0.1", at("20140215T1006Z")),
+			},
+			handled: []int{0, 1},
+			now:     at("20140215T1008Z"),
+			want:    -1,
+		},
+		{
+			name: "older interval settled",
+			listed: []*s3.Object{
+				testObject("20140215T1000Z", "172.16.0.1", at("20140215T1001Z")),
+				testObject("20140215T1005Z", "172.16.0.1", at("20140215T1006Z")),
+			},
+			handled: []int{0, 1},
+			now:     at("20140215T1012Z"),
+			want:    0,
+		},
+		{
+			name: "unhandled object",
+			listed: []*s3.Object{
+				testObject("20140215T0950Z", "172.16.0.1", at("20140215T0951Z")),
+				testObject("20140215T0955Z", "172.16.0.1", at("20140215T0956Z")),
+			},
+			handled: []int{1},
+			now:     at("20140215T1030Z"),
+			want:    -1,
+		},
+	}
+
+	for _, test := range tests {
+		handled := make(map[string]bool)
+		for _, i := range test.handled {
+			handled[*test.listed[i].Key] = true
+		}
+		want := ""
+		if test.want >= 0 {
+			want = *test.listed[test.want].Key
+		}
+		if got := newCursor(test.listed, handled, test.now); got != want {
+			t.Errorf("%s: got cursor %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+// A node which delivers its object late, after one sorting after it has been
+// handled, still has its object listed.
+func TestNewCursorLateKey(t *testing.T) {
+	start := time.Date(2014, 2, 15, 10, 6, 0, 0, time.UTC)
+	early := testObject("20140215T1005Z", "172.16.0.1", start)
+	late := testObject("20140215T1005Z", "10.0.0.5", start.Add(3*time.Minute))
+
+	// The first poll only finds the early object. The late one sorts
+	// before it, so moving the cursor past the early one would mean never
+	// listing the late one.
+	cursor := newCursor([]*s3.Object{early}, map[string]bool{*early.Key: true}, start.Add(time.Minute))
+	if cursor != "" && *late.Key <= cursor {
+		t.Fatalf("cursor moved to %q, so late object %q would not be listed", cursor, *late.Key)
+	}
+
+	// Once the interval has settled, the cursor moves past both.
+	handled := map[string]bool{*early.Key: true, *late.Key: true}
+	cursor = newCursor([]*s3.Object{late, early}, handled, start.Add(15*time.Minute))
+	if cursor != *early.Key {
+		t.Fatalf("got cursor %q, want %q", cursor, *early.Key)
+	}
+}
+
+func TestKeyTime(t *testing.T) {
+	lastModified := time.Date(2014, 2, 16, 1, 2, 3, 0, time.UTC)
+	tests := []struct {
+		key  string
+		want time.Time
+	}{
+		{
+			key:  "AWSLogs/123456789012/elasticloadbalancing/us-west-2/2014/02/15/123456789012_elasticloadbalancing_us-west-2_my-loadbalancer_20140215T2340Z_172.160.001.192_20sg8hgm.log",
+			want: time.Date(2014, 2, 15, 23, 40, 0, 0, time.UTC),
+		},
+		{
+			key:  "123456789012_elasticloadbalancing_us-west-2_my-loadbalancer_20140215T0005Z_10.0.0.1_abc.log",
+			want: time.Date(2014, 2, 15, 0, 5, 0, 0, time.UTC),
+		},
+		{
+			key:  "AWSLogs/123456789012/ELBAccessLogTestFile",
+			want: lastModified,
+		},
+	}
+
+	for _, test := range tests {
+		obj := &s3.Object{Key: aws.String(test.key), LastModified: aws.Time(lastModified)}
+		if got := keyTime(obj); !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.key, got, test.want)
+		}
+	}
+}
+
+func TestSortObjects(t *testing.T) {
+	modified := time.Date(2014, 2, 15, 12, 0, 0, 0, time.UTC)
+	// Out of time order, as when gathered across pages. Objects covering
+	// the same time keep this order.
+	listed := []*s3.Object{
+		testObject("20140215T1005Z", "10.0.0.1", modified),
+		testObject("20140215T1005Z", "172.16.0.1", modified),
+		testObject("20140215T0955Z", "172.16.0.1", modified),
+		{
+			Key:          aws.String("AWSLogs/123456789012/ELBAccessLogTestFile"),
+			LastModified: aws.Time(time.Date(2014, 2, 15, 10, 0, 0, 0, time.UTC)),
+		},
+		testObject("20140215T1000Z", "10.0.0.1", modified),
+	}
+
+	tests := []struct {
+		newestFirst bool
+		want        []int // indexes into listed
+	}{
+		{newestFirst: false, want: []int{2, 3, 4, 0, 1}},
+		{newestFirst: true, want: []int{0, 1, 3, 4, 2}},
+	}
+
+	for _, test := range tests {
+		objects := make([]*s3.Object, len(listed))
+		copy(objects, listed)
+
+		o := &ObjectDownloadParser{NewestFirst: test.newestFirst}
+		o.sortObjects(objects)
+
+		for i, want := range test.want {
+			if objects[i] != listed[want] {
+				got := make([]string, len(objects))
+				for j, obj := range objects {
+					got[j] = *obj.Key
+				}
+				t.Errorf("newest first %v: got order %v, want listed objects %v", test.newestFirst, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package logbucket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeyelb/statedir"
+)
+
+const (
+	// Somewhat arbitrary -- usually we see about 50 objects per hour in
+	// Honeycomb dogfood data.
+	//
+	// Important thing is that the length is capped and does not grow
+	// indefinitely, old objects will not need de-dupe protection as they
+	// will not be processed once the backfill interval has elapsed.
+	maxProcessedObjects = 2000
+
+	// How many times to try processing an object before leaving it for
+	// 'honeyelb replay'.
+	maxObjectAttempts = 5
+
+	// Retries of failed objects back off exponentially from
+	// objectRetryBaseDelay.
+	objectRetryBaseDelay = 5 * time.Minute
+
+	stateFileFormat = "%s-state-%s.json"
+)
+
+// FailedObject is an object which could not be processed.
+type FailedObject struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// ingestState is what is kept in the state file of an entity: which objects
+// have been processed, which have failed, and where listing is up to.
+type ingestState struct {
+	Processed []string                 `json:"processed"`
+	Failed    map[string]*FailedObject `json:"failed"`
+
+	// The last key listed under each prefix, for listing to start after
+	// next time. Prefixes are per day, so only the latest is kept.
+	Cursors map[string]string `json:"cursors,omitempty"`
+}
+
+func objectRecord(key string) string {
+	return strings.Replace(key, "/", "_", -1)
+}
+
+func (s *ingestState) isProcessed(key string) bool {
+	record := objectRecord(key)
+	for _, obj := range s.Processed {
+		if obj == record {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ingestState) markProcessed(key string) {
+	delete(s.Failed, key)
+
+	s.Processed = append(s.Processed, objectRecord(key))
+	if len(s.Processed) > maxProcessedObjects {
+		// "rotate" oldest remembered object out so state file
+		// does not grow indefinitely
+		s.Processed = s.Processed[1:]
+	}
+}
+
+func (s *ingestState) recordFailure(bucketName, key string, err error) *FailedObject {
+	failure, ok := s.Failed[key]
+	if !ok {
+		failure = &FailedObject{Bucket: bucketName, Key: key}
+		s.Failed[key] = failure
+	}
+
+	failure.Error = err.Error()
+	failure.Attempts++
+	failure.LastAttempt = time.Now().UTC()
+	failure.NextAttempt = failure.LastAttempt.Add(objectRetryBaseDelay << uint(failure.Attempts-1))
+
+	return failure
+}
+
+func (s *ingestState) cursor(prefix string) string {
+	return s.Cursors[prefix]
+}
+
+func (s *ingestState) setCursor(prefix, key string) {
+	s.Cursors = map[string]string{prefix: key}
+}
+
+// failures returns the failed objects, oldest key first.
+func (s *ingestState) failures() []*FailedObject {
+	failures := []*FailedObject{}
+	for _, failure := range s.Failed {
+		failures = append(failures, failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Key < failures[j].Key
+	})
+	return failures
+}
+
+func (o *ObjectDownloadParser) stateFile() string {
+	return filepath.Join(o.StateDir, fmt.Sprintf(stateFileFormat, o.Service, o.Entity))
+}
+
+func (o *ObjectDownloadParser) loadState() (*ingestState, error) {
+	state := &ingestState{Failed: make(map[string]*FailedObject)}
+
+	data, err := ioutil.ReadFile(o.stateFile())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading object cursor file: %s", err)
+	}
+
+	// State files from older versions are just the list of processed
+	// objects.
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &state.Processed)
+	} else {
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshalling state file JSON failed: %s", err)
+	}
+	if state.Failed == nil {
+		state.Failed = make(map[string]*FailedObject)
+	}
+
+	return state, nil
+}
+
+func (o *ObjectDownloadParser) saveState(state *ingestState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+
+	if err := statedir.WriteFile(o.stateFile(), data, 0644); err != nil {
+		return fmt.Errorf("Writing file failed: %s", err)
+	}
+
+	return nil
+}
+
+// StateEntities returns the names of the entities of the service which have
+// state files in the state directory.
+func StateEntities(stateDir, service string) ([]string, error) {
+	prefix := fmt.Sprintf(stateFileFormat, service, "")
+	prefix = strings.TrimSuffix(prefix, ".json")
+
+	paths, err := filepath.Glob(filepath.Join(stateDir, prefix+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	entities := []string{}
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), ".json")
+		entities = append(entities, name)
+	}
+	return entities, nil
+}
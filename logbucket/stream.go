@@ -0,0 +1,122 @@
+package logbucket
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// How many times to resume reading an object after the connection
+	// drops, before giving up on it.
+	maxObjectResumes = 5
+
+	resumeBaseDelay = time.Second
+)
+
+// objectReader reads an object's body from S3. If the connection fails partway
+// through, it picks up where it left off with a range request for the rest of
+// the same version of the object.
+type objectReader struct {
+	s3svc      *s3.S3
+	bucketName string
+	key        string
+
+	body    io.ReadCloser
+	etag    string
+	offset  int64
+	resumes int
+}
+
+func newObjectReader(s3svc *s3.S3, bucketName, key string) (*objectReader, error) {
+	r := &objectReader{
+		s3svc:      s3svc,
+		bucketName: bucketName,
+		key:        key,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *objectReader) open() error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(r.key),
+	}
+	if r.offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", r.offset))
+		input.IfMatch = aws.String(r.etag)
+	}
+
+	resp, err := r.s3svc.GetObject(input)
+	if err != nil {
+		return fmt.Errorf("Error getting object: %s", err)
+	}
+
+	r.body = resp.Body
+	if r.etag == "" {
+		r.etag = aws.StringValue(resp.ETag)
+	}
+	return nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	r.body.Close()
+	for r.resumes < maxObjectResumes {
+		r.resumes++
+
+		logrus.WithFields(logrus.Fields{
+			"key":     r.key,
+			"offset":  r.offset,
+			"resumes": r.resumes,
+			"error":   err,
+		}).Warn("Error reading object, resuming")
+
+		time.Sleep(resumeBaseDelay << uint(r.resumes-1))
+		if openErr := r.open(); openErr != nil {
+			err = openErr
+			continue
+		}
+
+		// Return what was read before the error; the caller will
+		// carry on reading from the resumed body.
+		return n, nil
+	}
+
+	return n, fmt.Errorf("Error reading object after %d resumes: %s", r.resumes, err)
+}
+
+func (r *objectReader) Close() error {
+	return r.body.Close()
+}
+
+// decompress returns a reader of r's contents, gunzipped if they are gzipped.
+// Application load balancers' access logs are, classic load balancers' aren't.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// Too short to be gzipped, or not gzipped at all.
+		return br, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading gzipped object: %s", err)
+	}
+	return gz, nil
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
-	"github.com/honeycombio/honeyelb/logbucket"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/honeycombio/honeyelb/accesslogs"
+	"github.com/honeycombio/honeyelb/discovery"
+	"github.com/honeycombio/honeyelb/doctor"
+	"github.com/honeycombio/honeyelb/iampolicy"
 	"github.com/honeycombio/honeyelb/options"
-	"github.com/honeycombio/honeyelb/publisher"
 	libhoney "github.com/honeycombio/libhoney-go"
 	flag "github.com/jessevdk/go-flags"
 )
 
 var (
-	opt        = &options.Options{}
+	opt        *options.Options
 	BuildID    string
 	versionStr string
 )
@@ -43,115 +47,119 @@ func cmdELB(args []string) error {
 
 	elbSvc := elb.New(sess, nil)
 
-	describeLBResp, err := elbSvc.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{})
-	if err != nil {
-		return fmt.Errorf("Error describing LBs: ", err)
-		os.Exit(1)
-	}
-
 	if len(args) > 0 {
 		switch args[0] {
 		case "ls", "list":
-			for _, lb := range describeLBResp.LoadBalancerDescriptions {
-				fmt.Println(*lb.LoadBalancerName)
+			lbNames, err := discovery.LoadBalancerNames(elbSvc)
+			if err != nil {
+				return err
 			}
 
-			return nil
-
-		case "ingest":
-			if opt.WriteKey == "" {
-				logrus.Fatal(`--writekey must be set to the proper write key for the Honeycomb team.
-Your write key is available at https://ui.honeycomb.io/account`)
+			for _, lbName := range lbNames {
+				fmt.Println(lbName)
 			}
 
-			lbNames := args[1:]
+			return nil
 
-			// Use all available load balancers by default if none
-			// are provided.
+		case "enable-logs":
+			lbNames := args[1:]
 			if len(lbNames) == 0 {
-				for _, lb := range describeLBResp.LoadBalancerDescriptions {
-					lbNames = append(lbNames, *lb.LoadBalancerName)
-				}
+				return fmt.Errorf("enable-logs requires the names of the load balancers to enable access logs for")
+			}
+			if opt.Bucket == "" {
+				return fmt.Errorf("--bucket must be set to the S3 bucket to deliver access logs to")
 			}
 
-			// Use this one publisher instance for all ObjectDownloadParsers.
-			defaultPublisher := publisher.NewHoneycombPublisher(opt, publisher.AWSElasticLoadBalancerFormat)
+			enabler := accesslogs.NewEnabler(sess, opt.Bucket, opt.Prefix, opt.DryRun, os.Stdout)
+			return enabler.Enable(lbNames)
 
-			// For now, just run one goroutine per-LB
-			for _, lbName := range lbNames {
-				logrus.WithFields(logrus.Fields{
-					"lbName": lbName,
-				}).Info("Attempting to ingest LB")
-
-				elbSvc := elb.New(sess, nil)
-
-				lbResp, err := elbSvc.DescribeLoadBalancerAttributes(&elb.DescribeLoadBalancerAttributesInput{
-					LoadBalancerName: aws.String(lbName),
-				})
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Error describing load balancers: ", err)
-					os.Exit(1)
-				}
+		case "doctor":
+			results := doctor.Run(sess, opt, ingestLBNames(args[1:], opt))
+			if !doctor.PrintTable(os.Stdout, results) {
+				return fmt.Errorf("One or more checks failed")
+			}
 
-				accessLog := lbResp.LoadBalancerAttributes.AccessLog
+			return nil
 
-				if !*accessLog.Enabled {
-					fmt.Fprintf(os.Stderr, `Access logs are not configured for ELB %q. Please enable them to use the ingest tool.
+		case "policy":
+			// Cover the same load balancers as ingest would.
+			lbNames := ingestLBNames(args[1:], opt)
+			if len(lbNames) == 0 {
+				fmt.Fprintln(os.Stderr, `No load balancers named or targeted in the config file, so the policy will cover all of those which exist now.
+Load balancers created later will need the policy to be regenerated.`)
+			}
 
-For reference see this link:
+			userResp, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+			if err != nil {
+				return fmt.Errorf("Error trying to get account ID: %s", err)
+			}
 
-http://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html#enable-access-logging
-`, lbName)
-					os.Exit(1)
-				}
-				logrus.WithFields(logrus.Fields{
-					"bucket": *accessLog.S3BucketName,
-					"lbName": lbName,
-				}).Info("Access logs are enabled for ELB ♥")
-
-				downloadParser := logbucket.ObjectDownloadParser{
-					Service:            logbucket.AWSElasticLoadBalancing,
-					Entity:             lbName,
-					HoneycombPublisher: defaultPublisher,
-					StateDir:           opt.StateDir,
+			lbs, skipped, err := discovery.Describe(elbSvc, lbNames)
+			if err != nil {
+				return err
+			}
+			if len(skipped) > 0 {
+				return fmt.Errorf("Could not describe load balancers: %s", strings.Join(skipped, ", "))
+			}
+			for _, lb := range lbs {
+				if !lb.AccessLogEnabled {
+					fmt.Fprintf(os.Stderr, "Access logs are not enabled for ELB %q, leaving it out of the policy.\n", lb.Name)
 				}
-
-				// TODO: One-goroutine-per-LB is a bit silly.
-				//
-				// Finish implementing a proper 'pipeline'
-				// instead using channels:
-				//
-				// (Query Objects to Process) => (Download Objects) => (Parse Objects) => (Send to HC)
-				go downloadParser.Ingest(sess, *accessLog.S3BucketName, *accessLog.S3BucketPrefix)
 			}
 
-			signalCh := make(chan os.Signal)
-
-			// block forever (until interrupt)
-			select {
-			case <-signalCh:
-				logrus.Info("Exiting due to interrupt.")
-				// TODO(nathanleclaire): Cleanup before
-				// exiting.
-				//
-				// 1. Delete format file, even
-				//    though it's in /tmp.
-				// 2. Also, wait for existing in-flight object
-				//    parsing / sending to finish so that state of
-				//    parsing "cursor" can be written to the JSON
-				//    file.
-				os.Exit(0)
+			policy := iampolicy.Generate(*userResp.Account, *sess.Config.Region, lbs)
+			policyJSON, err := json.MarshalIndent(policy, "", "    ")
+			if err != nil {
+				return fmt.Errorf("Marshalling JSON failed: %s", err)
 			}
+			fmt.Println(string(policyJSON))
+
+			return nil
+
+		case "ingest":
+			return cmdIngest(sess, elbSvc, args[1:])
+
+		case "replay":
+			return cmdReplay(sess, args[1:])
 		}
 	}
 
 	return fmt.Errorf("Subcommand %q not recognized", args[0])
 }
 
-func main() {
-	flagParser := flag.NewParser(opt, flag.Default)
+// parseOptions builds a fresh set of options from the config file (if any),
+// environment and command line.
+func parseOptions(parserOpts flag.Options) (*options.Options, []string, error) {
+	parsed := &options.Options{}
+	flagParser := flag.NewParser(parsed, parserOpts)
+
+	// The config file provides defaults for the flags, so needs to be
+	// loaded before they are parsed.
+	if configFile := options.ConfigFilePath(os.Args[1:]); configFile != "" {
+		if err := options.LoadConfigFile(flagParser, parsed, configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	args, err := flagParser.Parse()
 	if err != nil {
+		return nil, nil, err
+	}
+
+	return parsed, args, parsed.Validate()
+}
+
+func main() {
+	var (
+		args []string
+		err  error
+	)
+	opt, args, err = parseOptions(flag.Default)
+	if err != nil {
+		// Flag parsing errors have already been printed.
+		if _, isFlagErr := err.(*flag.Error); !isFlagErr {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+		}
 		os.Exit(1)
 	}
 
@@ -160,7 +168,10 @@ func main() {
 		logrus.WithField("version", versionStr).Debug("Starting honeyelb")
 	}
 
-	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) {
+	// doctor reports on the state directory itself rather than bailing out.
+	isDoctor := len(args) > 0 && args[0] == "doctor"
+
+	if _, err := os.Stat(opt.StateDir); os.IsNotExist(err) && !isDoctor {
 		logrus.WithField("dir", opt.StateDir).Fatal("Specified state directory does not exist")
 	}
 
@@ -170,7 +181,7 @@ func main() {
 	}
 
 	if len(args) == 0 {
-		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest] [ELB names...]
+		fmt.Fprintln(os.Stderr, `Usage: `+os.Args[0]+` [--flags] [ls|ingest|replay|enable-logs|doctor|policy] [ELB names...]
 
 Use '`+os.Args[0]+` --help' to see available flags.`)
 		os.Exit(1)
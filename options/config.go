@@ -0,0 +1,103 @@
+package options
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	flag "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file keys which are not also flags.
+const (
+	targetsKey       = "targets"
+	samplingRulesKey = "sampling_rules"
+)
+
+// ConfigFilePath finds the config file path from the command line arguments or
+// environment, before they are parsed properly.
+func ConfigFilePath(args []string) string {
+	pre := &struct {
+		ConfigFile string `long:"config" env:"HONEYELB_CONFIG"`
+	}{}
+
+	// Errors are left for the real parse to report.
+	flag.NewParser(pre, flag.IgnoreUnknown).ParseArgs(args)
+
+	return pre.ConfigFile
+}
+
+// LoadConfigFile reads the YAML config file at path and uses its top level
+// settings as the defaults of the flags of the same name, so that flags and
+// environment variables still take precedence over it. It must be called
+// before the parser parses the command line. The file's targets and sampling
+// rules are stored in opt.Targets and opt.SamplingRules.
+func LoadConfigFile(parser *flag.Parser, opt *Options, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %s", err)
+	}
+
+	settings := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("Error parsing config file %s: %s", path, err)
+	}
+
+	for name, value := range settings {
+		if name == targetsKey || name == samplingRulesKey {
+			continue
+		}
+
+		option := parser.FindOptionByLongName(name)
+		if option == nil {
+			return fmt.Errorf("Unknown setting %q in config file %s", name, path)
+		}
+
+		// Lists and maps become one default per element, like
+		// repeated flags.
+		switch values := value.(type) {
+		case []interface{}:
+			option.Default = nil
+			for _, v := range values {
+				option.Default = append(option.Default, fmt.Sprint(v))
+			}
+		case map[interface{}]interface{}:
+			option.Default = nil
+			for k, v := range values {
+				option.Default = append(option.Default, fmt.Sprintf("%v:%v", k, v))
+			}
+		default:
+			option.Default = []string{fmt.Sprint(value)}
+		}
+	}
+
+	targets := []Target{}
+	if err := decodeSetting(settings, targetsKey, &targets); err != nil {
+		return fmt.Errorf("Error parsing targets in config file %s: %s", path, err)
+	}
+
+	for i, target := range targets {
+		if target.LoadBalancer == "" {
+			return fmt.Errorf("Target %d in config file %s has no lb set", i+1, path)
+		}
+	}
+	opt.Targets = targets
+
+	rules := []SamplingRule{}
+	if err := decodeSetting(settings, samplingRulesKey, &rules); err != nil {
+		return fmt.Errorf("Error parsing sampling rules in config file %s: %s", path, err)
+	}
+	opt.SamplingRules = rules
+
+	return nil
+}
+
+// decodeSetting round trips a setting so that it can be strictly decoded (to
+// catch typos) without tripping over the other settings.
+func decodeSetting(settings map[string]interface{}, key string, out interface{}) error {
+	data, err := yaml.Marshal(settings[key])
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, out)
+}
@@ -0,0 +1,33 @@
+package options
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ClientNetwork names a range of client addresses, e.g., an office's or a
+// VPC's.
+type ClientNetwork struct {
+	Name string
+	Net  *net.IPNet
+}
+
+// ParseClientNetworks parses client networks given as name=cidr, e.g.,
+// "office=203.0.113.0/24" or "vpc=2001:db8::/32".
+func ParseClientNetworks(specs []string) ([]ClientNetwork, error) {
+	networks := make([]ClientNetwork, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid client network %q, expected name=cidr", spec)
+		}
+
+		_, ipNet, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client network %q: %s", spec, err)
+		}
+		networks = append(networks, ClientNetwork{Name: parts[0], Net: ipNet})
+	}
+	return networks, nil
+}
@@ -1,12 +1,217 @@
 package options
 
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"time"
+)
+
 type Options struct {
-	Dataset    string `long:"dataset" description:"Name of the dataset" default:"aws-elb-access"`
-	SampleRate int    `long:"samplerate" description:"Only send 1 / N log lines" default:"1"`
-	WriteKey   string `long:"writekey" description:"Honeycomb team write key"`
-	StateDir   string `long:"statedir" description:"Directory where ingest state is stored" default:"."`
+	ConfigFile  string `long:"config" env:"HONEYELB_CONFIG" description:"YAML config file with settings and per-load-balancer targets"`
+	WatchConfig bool   `long:"watch-config" description:"Reload the config file when it changes, as well as on SIGHUP"`
+
+	Dataset         string            `long:"dataset" env:"HONEYELB_DATASET" description:"Name of the dataset" default:"aws-elb-access"`
+	DatasetTemplate string            `long:"dataset-template" env:"HONEYELB_DATASET_TEMPLATE" description:"Template for per-load-balancer dataset names, e.g. 'elb-{{.Env}}-{{.LBName}}'. Overrides --dataset"`
+	DatasetMap      map[string]string `long:"dataset-map" description:"Dataset for a single load balancer, as lb:dataset. Overrides --dataset-template. May be repeated"`
+	Env             string            `long:"env" env:"HONEYELB_ENV" description:"Name of the environment, available to --dataset-template as {{.Env}}"`
+
+	SampleRate int           `long:"samplerate" env:"HONEYELB_SAMPLERATE" description:"Sample rate: the rate in static sampling mode, and the goal rate of the dynamic samplers which have one" default:"1"`
+	WriteKey   string        `long:"writekey" env:"HONEYELB_WRITEKEY" description:"Honeycomb team write key"`
+	StateDir   string        `long:"statedir" env:"HONEYELB_STATEDIR" description:"Directory where ingest state is stored" default:"."`
+	Backfill   time.Duration `long:"backfill" env:"HONEYELB_BACKFILL" description:"How far back to ingest access logs from" default:"1h"`
+	TempFiles  bool          `long:"temp-files" env:"HONEYELB_TEMP_FILES" description:"Download each access log object to a temporary file before parsing it, instead of streaming it"`
+	Order      string        `long:"order" env:"HONEYELB_ORDER" description:"Order to process each poll's access log objects in" choice:"oldest-first" choice:"newest-first" default:"oldest-first"`
+
+	SamplingMode            string          `long:"sampling-mode" env:"HONEYELB_SAMPLING_MODE" description:"How events are sampled: not at all, at --samplerate, by the dynamic sampler, or by the sampling rules then the dynamic sampler" choice:"none" choice:"static" choice:"dynamic" choice:"rules" default:"rules"`
+	Sampler                 string          `long:"sampler" env:"HONEYELB_SAMPLER" description:"Dynamic sampler to use" choice:"avgsamplerate" choice:"avgsamplewithmin" choice:"perkeythroughput" choice:"totalthroughput" choice:"onlyonce" choice:"static" default:"avgsamplerate"`
+	SamplerClearFrequency   time.Duration   `long:"sampler-clear-frequency" env:"HONEYELB_SAMPLER_CLEAR_FREQUENCY" description:"How often the sampler recalculates its sample rates" default:"5m"`
+	SamplerGoalThroughput   int             `long:"sampler-goal-throughput" env:"HONEYELB_SAMPLER_GOAL_THROUGHPUT" description:"Events per second to send in total (totalthroughput only)" default:"100"`
+	SamplerPerKeyThroughput int             `long:"sampler-per-key-throughput" env:"HONEYELB_SAMPLER_PER_KEY_THROUGHPUT" description:"Events per second to send for each key (perkeythroughput only)" default:"10"`
+	SamplerMinEventsPerSec  int             `long:"sampler-min-events-per-sec" env:"HONEYELB_SAMPLER_MIN_EVENTS_PER_SEC" description:"Below this many events per second, don't sample at all (avgsamplewithmin only)" default:"50"`
+	LatencyBuckets          []time.Duration `long:"latency-bucket" env:"HONEYELB_LATENCY_BUCKETS" env-delim:"," description:"Boundary between buckets of total request latency, for the latency_bucket sample key field. May be repeated" default:"100ms" default:"500ms" default:"1s" default:"2s" default:"5s"`
+	SampleKey               []string        `long:"sample-key" env:"HONEYELB_SAMPLE_KEY" env-delim:"," description:"Field whose value is part of the key that sample rates are calculated for, e.g., request_method, request_shape or latency_bucket. May be repeated" default:"backend_status_code" default:"elb_status_code" default:"elb"`
+	SamplerRates            map[string]int  `long:"sampler-rate" description:"Sample rate for a single key, as key:rate. Keys without one use --samplerate (static only). May be repeated"`
+
+	ClientNetworks []string `long:"client-network" env:"HONEYELB_CLIENT_NETWORKS" env-delim:"," description:"Range of client addresses to name in client_network, as name=cidr, e.g. office=203.0.113.0/24. The first match wins, and clients in none are 'internet'. May be repeated"`
+	GeoIPDB        string   `long:"geoip-db" env:"HONEYELB_GEOIP_DB" description:"MaxMind City or Country database (.mmdb) to look up client_country, client_region and client_city in"`
+	ASNDB          string   `long:"asn-db" env:"HONEYELB_ASN_DB" description:"MaxMind ASN database (.mmdb) to look up client_asn and client_org in"`
+	GeoIPCacheSize int      `long:"geoip-cache-size" env:"HONEYELB_GEOIP_CACHE_SIZE" description:"How many client addresses' GeoIP and ASN lookups to cache" default:"10000"`
+
+	Bucket string `long:"bucket" description:"S3 bucket to deliver access logs to (enable-logs only)"`
+	Prefix string `long:"prefix" description:"Prefix within the bucket to deliver access logs to (enable-logs only)"`
+	DryRun bool   `long:"dry-run" description:"Print the changes which would be made instead of making them (enable-logs only)"`
+
+	DiscoveryInterval time.Duration `long:"discovery-interval" env:"HONEYELB_DISCOVERY_INTERVAL" description:"How often to look for new, removed or changed load balancers" default:"5m"`
+	PollInterval      time.Duration `long:"poll-interval" env:"HONEYELB_POLL_INTERVAL" description:"How often to look for new access log objects" default:"5m"`
+	AdaptivePoll      bool          `long:"adaptive-poll" env:"HONEYELB_ADAPTIVE_POLL" description:"Poll just after each load balancer is expected to publish its access logs, based on its emit interval, instead of every --poll-interval"`
 
 	Version bool   `short:"V" long:"version" description:"Show version"`
-	APIHost string `hidden:"true" long:"api_host" description:"Host for the Honeycomb API" default:"https://api.honeycomb.io/"`
-	Debug   bool   `long:"debug" description:"Print debugging output"`
+	APIHost string `hidden:"true" long:"api_host" env:"HONEYELB_API_HOST" description:"Host for the Honeycomb API" default:"https://api.honeycomb.io/"`
+	Debug   bool   `long:"debug" env:"HONEYELB_DEBUG" description:"Print debugging output"`
+
+	// Per-load-balancer settings, only available from the config file.
+	Targets []Target `no-flag:"true"`
+
+	// Sampling rules for every target without its own, only available
+	// from the config file.
+	SamplingRules []SamplingRule `no-flag:"true"`
+}
+
+// Target overrides the global settings for a single load balancer. Any zero
+// valued setting falls back to the global one.
+type Target struct {
+	LoadBalancer string        `yaml:"lb"`
+	Dataset      string        `yaml:"dataset"`
+	SampleRate   int           `yaml:"samplerate"`
+	WriteKey     string        `yaml:"writekey"`
+	APIHost      string        `yaml:"api_host"`
+	Backfill     time.Duration `yaml:"backfill"`
+	Transforms   Transforms    `yaml:"transforms"`
+	Sampler      Sampler       `yaml:"sampler"`
+
+	// Set to an empty list to not classify clients at all.
+	ClientNetworks []string `yaml:"client_networks"`
+}
+
+// Transforms are applied to every event of a target before it is sent.
+type Transforms struct {
+	// Fields to remove.
+	Drop []string `yaml:"drop"`
+
+	// Fields to rename, from old name to new name.
+	Rename map[string]string `yaml:"rename"`
+
+	// Fields to add, with a fixed value.
+	Add map[string]interface{} `yaml:"add"`
+}
+
+// DatasetTemplateData is what --dataset-template is rendered with.
+type DatasetTemplateData struct {
+	LBName string
+	Env    string
+}
+
+// Validate checks the options for mistakes which can't be caught by the flag
+// parser.
+func (opt *Options) Validate() error {
+	if opt.DatasetTemplate != "" {
+		tmpl, err := template.New("dataset").Option("missingkey=error").Parse(opt.DatasetTemplate)
+		if err != nil {
+			return fmt.Errorf("Invalid --dataset-template: %s", err)
+		}
+		if err := tmpl.Execute(ioutil.Discard, DatasetTemplateData{}); err != nil {
+			return fmt.Errorf("Invalid --dataset-template: %s", err)
+		}
+	}
+
+	if err := validateRules(opt.SamplingRules); err != nil {
+		return err
+	}
+	if err := validateLatencyBuckets(opt.LatencyBuckets); err != nil {
+		return err
+	}
+	if opt.DiscoveryInterval <= 0 {
+		return fmt.Errorf("--discovery-interval must be positive")
+	}
+	if opt.PollInterval <= 0 {
+		return fmt.Errorf("--poll-interval must be positive")
+	}
+	if _, err := ParseClientNetworks(opt.ClientNetworks); err != nil {
+		return err
+	}
+	if opt.GeoIPCacheSize < 0 {
+		return fmt.Errorf("--geoip-cache-size must not be negative")
+	}
+	if opt.SampleRate < 1 {
+		return fmt.Errorf("--samplerate must be at least 1")
+	}
+	for _, t := range opt.Targets {
+		if t.SampleRate < 0 {
+			return fmt.Errorf("Invalid samplerate %d for target %s", t.SampleRate, t.LoadBalancer)
+		}
+		if t.Sampler.Mode != "" && !validSamplingModes[t.Sampler.Mode] {
+			return fmt.Errorf("Invalid sampling mode %q for target %s", t.Sampler.Mode, t.LoadBalancer)
+		}
+		if t.Sampler.Type != "" && !validSamplerTypes[t.Sampler.Type] {
+			return fmt.Errorf("Invalid sampler type %q for target %s", t.Sampler.Type, t.LoadBalancer)
+		}
+		if err := validateRules(t.Sampler.Rules); err != nil {
+			return fmt.Errorf("Target %s: %s", t.LoadBalancer, err)
+		}
+		if err := validateLatencyBuckets(t.Sampler.LatencyBuckets); err != nil {
+			return fmt.Errorf("Target %s: %s", t.LoadBalancer, err)
+		}
+		if _, err := ParseClientNetworks(t.ClientNetworks); err != nil {
+			return fmt.Errorf("Target %s: %s", t.LoadBalancer, err)
+		}
+	}
+
+	return nil
+}
+
+// datasetFor picks the dataset for a load balancer without a dataset set in
+// its target: from --dataset-map, else --dataset-template, else --dataset.
+func (opt *Options) datasetFor(lbName string) string {
+	if dataset, ok := opt.DatasetMap[lbName]; ok {
+		return dataset
+	}
+
+	if opt.DatasetTemplate != "" {
+		tmpl, err := template.New("dataset").Parse(opt.DatasetTemplate)
+		if err != nil {
+			return opt.Dataset
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, DatasetTemplateData{LBName: lbName, Env: opt.Env}); err != nil || buf.Len() == 0 {
+			return opt.Dataset
+		}
+		return buf.String()
+	}
+
+	return opt.Dataset
+}
+
+// Target returns the settings for the named load balancer, with the global
+// settings filled in wherever its target (if it has one) doesn't set them.
+func (opt *Options) Target(lbName string) Target {
+	target := Target{LoadBalancer: lbName}
+	for _, t := range opt.Targets {
+		if t.LoadBalancer == lbName {
+			target = t
+			break
+		}
+	}
+
+	if target.Dataset == "" {
+		target.Dataset = opt.datasetFor(lbName)
+	}
+	if target.SampleRate == 0 {
+		target.SampleRate = opt.SampleRate
+	}
+	if target.WriteKey == "" {
+		target.WriteKey = opt.WriteKey
+	}
+	if target.APIHost == "" {
+		target.APIHost = opt.APIHost
+	}
+	if target.Backfill == 0 {
+		target.Backfill = opt.Backfill
+	}
+	opt.fillSampler(&target.Sampler)
+	if target.ClientNetworks == nil {
+		target.ClientNetworks = opt.ClientNetworks
+	}
+
+	return target
+}
+
+// TargetNames returns the names of the load balancers which have targets.
+func (opt *Options) TargetNames() []string {
+	names := []string{}
+	for _, t := range opt.Targets {
+		names = append(names, t.LoadBalancer)
+	}
+	return names
 }
@@ -0,0 +1,66 @@
+package options
+
+import "fmt"
+
+// Sampling rule actions.
+const (
+	RuleKeep    = "keep"
+	RuleDrop    = "drop"
+	RuleDynamic = "dynamic"
+)
+
+var validRuleOps = map[string]bool{
+	"=": true, "!=": true,
+	">": true, ">=": true, "<": true, "<=": true,
+	"prefix": true, "contains": true, "exists": true,
+}
+
+// SamplingRule decides how the events it matches are sampled, before the
+// dynamic sampler gets a say. An event matches a rule if it meets all of the
+// rule's conditions. The rule then keeps all of them, drops all of them,
+// samples them at its fixed sample rate, or leaves them to the dynamic sampler.
+type SamplingRule struct {
+	Name       string      `yaml:"name"`
+	Conditions []Condition `yaml:"conditions"`
+
+	// One of keep, drop or dynamic, unless a sample rate is set instead.
+	Action     string `yaml:"action"`
+	SampleRate int    `yaml:"samplerate"`
+}
+
+// Condition compares a field of an event to a value. Numeric comparisons
+// need both to be numbers; prefix and contains need strings. exists ignores
+// the value.
+type Condition struct {
+	Field string      `yaml:"field"`
+	Op    string      `yaml:"op"`
+	Value interface{} `yaml:"value"`
+}
+
+func validateRules(rules []SamplingRule) error {
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("Sampling rule %d has no name", i+1)
+		}
+
+		switch {
+		case rule.Action == "" && rule.SampleRate < 1:
+			return fmt.Errorf("Sampling rule %q needs an action or a samplerate of at least 1", rule.Name)
+		case rule.Action != "" && rule.SampleRate != 0:
+			return fmt.Errorf("Sampling rule %q has both an action and a samplerate", rule.Name)
+		case rule.Action != "" && rule.Action != RuleKeep && rule.Action != RuleDrop && rule.Action != RuleDynamic:
+			return fmt.Errorf("Sampling rule %q has unknown action %q", rule.Name, rule.Action)
+		}
+
+		for _, cond := range rule.Conditions {
+			if cond.Field == "" {
+				return fmt.Errorf("Sampling rule %q has a condition with no field", rule.Name)
+			}
+			if !validRuleOps[cond.Op] {
+				return fmt.Errorf("Sampling rule %q has a condition with unknown op %q", rule.Name, cond.Op)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package options
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sampling modes, which decide what events' sample rates come from.
+const (
+	// Every event is sent, with a sample rate of 1.
+	SamplingNone = "none"
+
+	// Every event is sampled at the target's sample rate.
+	SamplingStatic = "static"
+
+	// Every event is sampled at the rate the dynamic sampler picks for
+	// its key.
+	SamplingDynamic = "dynamic"
+
+	// Events are sampled by the first sampling rule they match, and by
+	// the dynamic sampler if they match none (or a dynamic rule).
+	SamplingRules = "rules"
+)
+
+var validSamplingModes = map[string]bool{
+	SamplingNone:    true,
+	SamplingStatic:  true,
+	SamplingDynamic: true,
+	SamplingRules:   true,
+}
+
+// Sampler types, named after the dynsampler-go sampler they use.
+const (
+	SamplerAvgSampleRate    = "avgsamplerate"
+	SamplerAvgSampleWithMin = "avgsamplewithmin"
+	SamplerPerKeyThroughput = "perkeythroughput"
+	SamplerTotalThroughput  = "totalthroughput"
+	SamplerOnlyOnce         = "onlyonce"
+	SamplerStatic           = "static"
+)
+
+var validSamplerTypes = map[string]bool{
+	SamplerAvgSampleRate:    true,
+	SamplerAvgSampleWithMin: true,
+	SamplerPerKeyThroughput: true,
+	SamplerTotalThroughput:  true,
+	SamplerOnlyOnce:         true,
+	SamplerStatic:           true,
+}
+
+// Sampler configures how a target's events are sampled. The mode decides
+// whether the rules and the dynamic sampler are used at all. Which of the
+// other settings apply depends on the type; the target's sample rate is the
+// goal rate of the average sample rate samplers, and the default rate of the
+// static one.
+type Sampler struct {
+	Mode             string         `yaml:"mode"`
+	Type             string         `yaml:"type"`
+	ClearFrequency   time.Duration  `yaml:"clear_frequency"`
+	GoalThroughput   int            `yaml:"goal_throughput"`
+	PerKeyThroughput int            `yaml:"per_key_throughput"`
+	MinEventsPerSec  int            `yaml:"min_events_per_sec"`
+	Rates            map[string]int `yaml:"rates"`
+
+	// Fields whose values make up the key that sample rates are
+	// calculated for.
+	KeyFields []string `yaml:"key_fields"`
+
+	// Boundaries between the buckets of total latency which the
+	// latency_bucket key field puts events in.
+	LatencyBuckets []time.Duration `yaml:"latency_buckets"`
+
+	// Rules tried, in order, before the dynamic sampler.
+	Rules []SamplingRule `yaml:"rules"`
+}
+
+// fillSampler fills in the global sampler settings wherever the target's
+// don't set them.
+func (opt *Options) fillSampler(sampler *Sampler) {
+	if sampler.Mode == "" {
+		sampler.Mode = opt.SamplingMode
+	}
+	if sampler.Type == "" {
+		sampler.Type = opt.Sampler
+	}
+	if sampler.ClearFrequency == 0 {
+		sampler.ClearFrequency = opt.SamplerClearFrequency
+	}
+	if sampler.GoalThroughput == 0 {
+		sampler.GoalThroughput = opt.SamplerGoalThroughput
+	}
+	if sampler.PerKeyThroughput == 0 {
+		sampler.PerKeyThroughput = opt.SamplerPerKeyThroughput
+	}
+	if sampler.MinEventsPerSec == 0 {
+		sampler.MinEventsPerSec = opt.SamplerMinEventsPerSec
+	}
+	if sampler.Rates == nil {
+		sampler.Rates = opt.SamplerRates
+	}
+	if len(sampler.KeyFields) == 0 {
+		sampler.KeyFields = opt.SampleKey
+	}
+	if len(sampler.LatencyBuckets) == 0 {
+		sampler.LatencyBuckets = opt.LatencyBuckets
+	}
+	if sampler.Rules == nil {
+		sampler.Rules = opt.SamplingRules
+	}
+}
+
+func validateLatencyBuckets(boundaries []time.Duration) error {
+	for i := 1; i < len(boundaries); i++ {
+		if boundaries[i] <= boundaries[i-1] {
+			return fmt.Errorf("Latency bucket boundaries must be in ascending order, but %s comes after %s", boundaries[i], boundaries[i-1])
+		}
+	}
+	return nil
+}
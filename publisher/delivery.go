@@ -0,0 +1,187 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/libhoney-go"
+)
+
+const (
+	// How many times to try sending an event before giving up on it and
+	// writing it to the dead letter file.
+	maxSendAttempts = 5
+
+	// Retries back off exponentially from retryBaseDelay, up to
+	// retryMaxDelay.
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+)
+
+// delivery tracks the events published from a single reader until every one
+// has been either accepted by Honeycomb or given up on.
+type delivery struct {
+	hp *HoneycombPublisher
+	wg sync.WaitGroup
+
+	// Counts of events, updated atomically.
+	sent    int64
+	retried int64
+	failed  int64
+}
+
+// pendingEvent is carried through libhoney as an event's metadata, so that it
+// can be retried (or dead-lettered) when its response comes back.
+type pendingEvent struct {
+	delivery   *delivery
+	builder    *libhoney.Builder
+	timestamp  time.Time
+	sampleRate uint
+	data       map[string]interface{}
+	attempts   int
+}
+
+// send hands the event to libhoney. Its outcome is reported on the responses
+// channel, except when it can't even be queued, in which case it has failed
+// straight away.
+func (p *pendingEvent) send() {
+	p.attempts++
+
+	libhEv := p.builder.NewEvent()
+	libhEv.Timestamp = p.timestamp
+	libhEv.SampleRate = p.sampleRate
+	libhEv.Metadata = p
+	if err := libhEv.Add(p.data); err != nil {
+		p.fail(0, err)
+		return
+	}
+	// Sampling has already happened by now, so the event must be sent
+	// as-is.
+	if err := libhEv.SendPresampled(); err != nil {
+		p.fail(0, err)
+	}
+}
+
+func (p *pendingEvent) succeed() {
+	atomic.AddInt64(&p.delivery.sent, 1)
+	atomic.AddInt64(&p.delivery.hp.sent, 1)
+	p.delivery.wg.Done()
+}
+
+func (p *pendingEvent) retry(statusCode int, err error) {
+	delay := retryBaseDelay << uint(p.attempts-1)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"status":   statusCode,
+		"error":    err,
+		"attempts": p.attempts,
+		"delay":    delay,
+		"dataset":  p.builder.Dataset,
+	}).Debug("Retrying event")
+
+	atomic.AddInt64(&p.delivery.retried, 1)
+	atomic.AddInt64(&p.delivery.hp.retried, 1)
+	time.AfterFunc(delay, p.send)
+}
+
+func (p *pendingEvent) fail(statusCode int, err error) {
+	atomic.AddInt64(&p.delivery.failed, 1)
+	atomic.AddInt64(&p.delivery.hp.failed, 1)
+
+	if dlErr := p.delivery.hp.deadLetter(p, statusCode, err); dlErr != nil {
+		logrus.WithError(dlErr).Error("Error writing event to dead letter file, it has been lost")
+	}
+	p.delivery.wg.Done()
+}
+
+// deadLetterRecord is a line of the dead letter file.
+type deadLetterRecord struct {
+	Time       time.Time              `json:"time"`
+	Dataset    string                 `json:"dataset"`
+	Status     int                    `json:"status,omitempty"`
+	Error      string                 `json:"error"`
+	Attempts   int                    `json:"attempts"`
+	Timestamp  time.Time              `json:"timestamp"`
+	SampleRate uint                   `json:"samplerate"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// deadLetter appends an event which could not be sent to the publisher's dead
+// letter file, so that it isn't lost without a trace.
+func (hp *HoneycombPublisher) deadLetter(p *pendingEvent, statusCode int, err error) error {
+	line, jsonErr := json.Marshal(deadLetterRecord{
+		Time:       time.Now().UTC(),
+		Dataset:    p.builder.Dataset,
+		Status:     statusCode,
+		Error:      fmt.Sprint(err),
+		Attempts:   p.attempts,
+		Timestamp:  p.timestamp,
+		SampleRate: p.sampleRate,
+		Data:       p.data,
+	})
+	if jsonErr != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", jsonErr)
+	}
+
+	hp.deadLetterLock.Lock()
+	defer hp.deadLetterLock.Unlock()
+
+	f, openErr := os.OpenFile(hp.deadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if openErr != nil {
+		return fmt.Errorf("Error opening dead letter file: %s", openErr)
+	}
+	defer f.Close()
+
+	_, writeErr := f.Write(append(line, '\n'))
+	return writeErr
+}
+
+// isRetriable reports whether a failed send might succeed if tried again. Rate
+// limiting, server errors and errors reaching the API are; any other rejection
+// by the API, or an event which can't be encoded, is not.
+func isRetriable(resp libhoney.Response) bool {
+	// Events which the API responded to carry its error as well as its
+	// status, so the status decides.
+	if resp.StatusCode != 0 {
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	}
+
+	switch resp.Err.(type) {
+	case *json.UnsupportedTypeError, *json.UnsupportedValueError, *json.MarshalerError:
+		return false
+	}
+	return true
+}
+
+// handleResponses reads the outcome of every event sent by any publisher off
+// libhoney's responses channel, until it is closed.
+func handleResponses(responses <-chan libhoney.Response) {
+	for resp := range responses {
+		p, ok := resp.Metadata.(*pendingEvent)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case resp.Err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300:
+			p.succeed()
+		case isRetriable(resp) && p.attempts < maxSendAttempts:
+			p.retry(resp.StatusCode, resp.Err)
+		default:
+			err := resp.Err
+			if err == nil {
+				err = fmt.Errorf("rejected by Honeycomb API: %s", string(resp.Body))
+			}
+			p.fail(resp.StatusCode, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package publisher
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// The language of the place names looked up in the GeoIP database.
+const geoIPLanguage = "en"
+
+// geoIP is set by InitGeoIP, if GeoIP or ASN lookups are configured.
+var geoIP *geoIPLookup
+
+// geoIPLookup looks up the location and network of client IP addresses in
+// local MaxMind databases, caching the fields to add for each address.
+type geoIPLookup struct {
+	city  *maxminddb.Reader
+	asn   *maxminddb.Reader
+	cache *lruCache
+}
+
+// The parts of a City or Country database record which are used. Country
+// databases have no subdivisions or city.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// InitGeoIP opens the GeoIP and ASN databases at the given paths, either of
+// which may be empty to skip those lookups. It must be called before any
+// events are published for the lookups to happen. Everything is read from the
+// local files, so no network access is needed.
+func InitGeoIP(cityPath, asnPath string, cacheSize int) error {
+	if cityPath == "" && asnPath == "" {
+		return nil
+	}
+
+	lookup := &geoIPLookup{cache: newLRUCache(cacheSize)}
+	if cityPath != "" {
+		reader, err := openGeoIPDB(cityPath, "City", "Country")
+		if err != nil {
+			return err
+		}
+		lookup.city = reader
+	}
+	if asnPath != "" {
+		reader, err := openGeoIPDB(asnPath, "ASN", "ISP")
+		if err != nil {
+			return err
+		}
+		lookup.asn = reader
+	}
+
+	geoIP = lookup
+	return nil
+}
+
+// openGeoIPDB opens the database, checking that it's one of the given kinds
+// so that mixing up --geoip-db and --asn-db is caught.
+func openGeoIPDB(path string, kinds ...string) (*maxminddb.Reader, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening MaxMind database %s: %s", path, err)
+	}
+
+	dbType := reader.Metadata.DatabaseType
+	for _, kind := range kinds {
+		if strings.Contains(dbType, kind) {
+			return reader, nil
+		}
+	}
+	reader.Close()
+	return nil, fmt.Errorf("MaxMind database %s is a %s database, expected a %s one", path, dbType, strings.Join(kinds, " or "))
+}
+
+// fields returns the fields to add for the IP address.
+func (g *geoIPLookup) fields(ip string) map[string]interface{} {
+	if cached, ok := g.cache.get(ip); ok {
+		return cached.(map[string]interface{})
+	}
+
+	fields := make(map[string]interface{})
+	if addr := net.ParseIP(ip); addr != nil {
+		if g.city != nil {
+			g.lookupCity(addr, fields)
+		}
+		if g.asn != nil {
+			g.lookupASN(addr, fields)
+		}
+	}
+
+	g.cache.add(ip, fields)
+	return fields
+}
+
+func (g *geoIPLookup) lookupCity(addr net.IP, fields map[string]interface{}) {
+	var record geoIPRecord
+	if err := g.city.Lookup(addr, &record); err != nil {
+		logrus.WithError(err).WithField("ip", addr).Debug("Error looking up GeoIP record")
+		return
+	}
+
+	if record.Country.ISOCode != "" {
+		fields["client_country"] = record.Country.ISOCode
+	}
+	if len(record.Subdivisions) > 0 {
+		if region := record.Subdivisions[0].Names[geoIPLanguage]; region != "" {
+			fields["client_region"] = region
+		}
+	}
+	if city := record.City.Names[geoIPLanguage]; city != "" {
+		fields["client_city"] = city
+	}
+}
+
+func (g *geoIPLookup) lookupASN(addr net.IP, fields map[string]interface{}) {
+	var record asnRecord
+	if err := g.asn.Lookup(addr, &record); err != nil {
+		logrus.WithError(err).WithField("ip", addr).Debug("Error looking up ASN record")
+		return
+	}
+
+	if record.Number != 0 {
+		fields["client_asn"] = record.Number
+	}
+	if record.Organization != "" {
+		fields["client_org"] = record.Organization
+	}
+}
+
+// addGeoIPFields adds the location and network of the event's client, if
+// GeoIP or ASN lookups are configured.
+func addGeoIPFields(ev *event.Event) {
+	if geoIP == nil {
+		return
+	}
+	ip, ok := ev.Data["client_ip"].(string)
+	if !ok {
+		return
+	}
+	for field, val := range geoIP.fields(ip) {
+		ev.Data[field] = val
+	}
+}
@@ -0,0 +1,85 @@
+package publisher
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// The test databases have a record for every address from 128.0.0.0 up, and
+// none below.
+const (
+	testCityDB = "testdata/GeoIP2-City-Test.mmdb"
+	testASNDB  = "testdata/GeoLite2-ASN-Test.mmdb"
+)
+
+func TestGeoIPFields(t *testing.T) {
+	if err := InitGeoIP(testCityDB, testASNDB, 10); err != nil {
+		t.Fatalf("opening databases: %s", err)
+	}
+	defer func() { geoIP = nil }()
+
+	tests := []struct {
+		ip   string
+		want map[string]interface{}
+	}{
+		{
+			ip: "203.0.113.5",
+			want: map[string]interface{}{
+				"client_ip":      "203.0.113.5",
+				"client_country": "GB",
+				"client_region":  "England",
+				"client_city":    "London",
+				"client_asn":     uint(64496),
+				"client_org":     "Example Networks",
+			},
+		},
+		{
+			ip:   "10.0.0.1",
+			want: map[string]interface{}{"client_ip": "10.0.0.1"},
+		},
+		{
+			ip:   "not an address",
+			want: map[string]interface{}{"client_ip": "not an address"},
+		},
+	}
+
+	for _, test := range tests {
+		ev := event.Event{Data: map[string]interface{}{"client_ip": test.ip}}
+		addGeoIPFields(&ev)
+		if !reflect.DeepEqual(ev.Data, test.want) {
+			t.Errorf("%s: got %v, want %v", test.ip, ev.Data, test.want)
+		}
+	}
+}
+
+func TestGeoIPCachesLookups(t *testing.T) {
+	if err := InitGeoIP(testCityDB, "", 10); err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+	defer func() { geoIP = nil }()
+
+	first := geoIP.fields("203.0.113.5")
+
+	// Without the database, only the cache can have the fields.
+	geoIP.city.Close()
+	geoIP.city = nil
+	if again := geoIP.fields("203.0.113.5"); !reflect.DeepEqual(again, first) {
+		t.Errorf("got %v from the cache, want %v", again, first)
+	}
+}
+
+func TestInitGeoIPChecksDatabaseTypes(t *testing.T) {
+	defer func() { geoIP = nil }()
+
+	if err := InitGeoIP(testASNDB, "", 10); err == nil {
+		t.Error("opened an ASN database as the GeoIP one, want an error")
+	}
+	if err := InitGeoIP("", testCityDB, 10); err == nil {
+		t.Error("opened a City database as the ASN one, want an error")
+	}
+	if err := InitGeoIP("testdata/missing.mmdb", "", 10); err == nil {
+		t.Error("opened a missing database, want an error")
+	}
+}
@@ -0,0 +1,70 @@
+package publisher
+
+import (
+	"strings"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// The fields holding how long each part of handling a request took, in
+// seconds. The load balancer logs -1 for all of them when it couldn't get a
+// response from the backend.
+var processingTimeFields = []string{
+	"response_processing_time",
+	"request_processing_time",
+	"backend_processing_time",
+}
+
+// Fields derived from the processing times.
+const (
+	// The sum of the processing times which were measured, in
+	// milliseconds.
+	durationField = "duration_ms"
+
+	// Whether the backend didn't respond, because it timed out or
+	// because the connection to it failed.
+	backendTimedOutField         = "backend_timed_out"
+	backendConnectionFailedField = "backend_connection_failed"
+)
+
+// The load balancer responds with a 504 when the backend times out; any other
+// response without processing times means it couldn't be reached at all.
+const gatewayTimeout = 504
+
+// msField is the name of the field holding a processing time in milliseconds,
+// e.g., "backend_processing_ms" for "backend_processing_time".
+func msField(field string) string {
+	return strings.TrimSuffix(field, "_time") + "_ms"
+}
+
+// deriveLatencyFields adds the processing times in milliseconds, their total
+// and whether the backend failed to respond. The -1 processing times are
+// removed, so that they don't skew the real ones.
+func deriveLatencyFields(ev *event.Event) {
+	var total float64
+	measured, unmeasured := false, false
+	for _, f := range processingTimeFields {
+		t, ok := toFloat(ev.Data[f])
+		if !ok {
+			continue
+		}
+		if t < 0 {
+			delete(ev.Data, f)
+			unmeasured = true
+			continue
+		}
+		ev.Data[msField(f)] = t * 1000
+		total += t
+		measured = true
+	}
+
+	if measured {
+		ev.Data[durationField] = total * 1000
+	}
+	if measured || unmeasured {
+		status, _ := toFloat(ev.Data["elb_status_code"])
+		timedOut := unmeasured && status == gatewayTimeout
+		ev.Data[backendTimedOutField] = timedOut
+		ev.Data[backendConnectionFailedField] = unmeasured && !timedOut
+	}
+}
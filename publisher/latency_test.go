@@ -0,0 +1,101 @@
+package publisher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestDeriveLatencyFields(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "measured",
+			data: map[string]interface{}{
+				"request_processing_time":  0.5,
+				"backend_processing_time":  1.25,
+				"response_processing_time": 0.25,
+				"elb_status_code":          int64(200),
+			},
+			want: map[string]interface{}{
+				"request_processing_time":   0.5,
+				"backend_processing_time":   1.25,
+				"response_processing_time":  0.25,
+				"elb_status_code":           int64(200),
+				"request_processing_ms":     500.0,
+				"backend_processing_ms":     1250.0,
+				"response_processing_ms":    250.0,
+				"duration_ms":               2000.0,
+				"backend_timed_out":         false,
+				"backend_connection_failed": false,
+			},
+		},
+		{
+			name: "timed out",
+			data: map[string]interface{}{
+				"request_processing_time":  int64(-1),
+				"backend_processing_time":  int64(-1),
+				"response_processing_time": int64(-1),
+				"elb_status_code":          int64(504),
+			},
+			want: map[string]interface{}{
+				"elb_status_code":           int64(504),
+				"backend_timed_out":         true,
+				"backend_connection_failed": false,
+			},
+		},
+		{
+			name: "connection failed",
+			data: map[string]interface{}{
+				"request_processing_time":  int64(-1),
+				"backend_processing_time":  int64(-1),
+				"response_processing_time": int64(-1),
+				"elb_status_code":          int64(503),
+			},
+			want: map[string]interface{}{
+				"elb_status_code":           int64(503),
+				"backend_timed_out":         false,
+				"backend_connection_failed": true,
+			},
+		},
+		{
+			name: "no processing times",
+			data: map[string]interface{}{"elb_status_code": int64(200)},
+			want: map[string]interface{}{"elb_status_code": int64(200)},
+		},
+	}
+
+	for _, test := range tests {
+		ev := event.Event{Data: test.data}
+		deriveLatencyFields(&ev)
+		if !reflect.DeepEqual(ev.Data, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, ev.Data, test.want)
+		}
+	}
+}
+
+func TestLatencyBucket(t *testing.T) {
+	boundaries := []time.Duration{100 * time.Millisecond, time.Second}
+	tests := []struct {
+		data map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"backend_processing_time": 0.05}, "<100ms"},
+		{map[string]interface{}{"backend_processing_time": 0.5}, "100ms-1s"},
+		{map[string]interface{}{"request_processing_time": 0.5, "backend_processing_time": 0.5}, ">=1s"},
+		{map[string]interface{}{"backend_processing_time": int64(-1)}, ""},
+	}
+
+	for _, test := range tests {
+		ev := event.Event{Data: test.data}
+		deriveLatencyFields(&ev)
+		if got := latencyBucket(boundaries, &ev); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.data, got, test.want)
+		}
+	}
+}
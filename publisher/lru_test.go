@@ -0,0 +1,24 @@
+package publisher
+
+import "testing"
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", 1)
+	c.add("b", 2)
+
+	// Using a makes b the least recently used.
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Fatalf("a: got %v, %v, want 1, true", v, ok)
+	}
+	c.add("c", 3)
+
+	if _, ok := c.get("b"); ok {
+		t.Errorf("b still cached, want it evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("%s: got %v, %v, want %d, true", key, v, ok, want)
+		}
+	}
+}
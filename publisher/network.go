@@ -0,0 +1,78 @@
+package publisher
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeytail/event"
+)
+
+const (
+	clientNetworkField = "client_network"
+
+	// What client_network is for clients in none of the client networks.
+	defaultClientNetwork = "internet"
+)
+
+// splitAuthority splits an authority, as logged by the load balancer, into its
+// IP address and port. IPv6 addresses may or may not be bracketed, e.g.,
+// "[2001:db8::1]:443" or "2001:db8::1:443".
+func splitAuthority(authority string) (net.IP, int, bool) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		// Unbracketed IPv6 addresses have too many colons for
+		// SplitHostPort; the port is after the last one.
+		i := strings.LastIndex(authority, ":")
+		if i < 0 {
+			return nil, 0, false
+		}
+		host, port = authority[:i], authority[i+1:]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return ip, int(p), true
+}
+
+// addAuthorityFields adds the IP address and port of the authority in the
+// field as <prefix>_ip and <prefix>_port, and returns the IP address.
+func addAuthorityFields(ev *event.Event, field, prefix string) net.IP {
+	authority, ok := ev.Data[field].(string)
+	if !ok {
+		return nil
+	}
+	ip, port, ok := splitAuthority(authority)
+	if !ok {
+		return nil
+	}
+
+	ev.Data[prefix+"_ip"] = ip.String()
+	ev.Data[prefix+"_port"] = port
+	return ip
+}
+
+// addAddressFields splits the client and backend authorities into IP
+// addresses and ports, and names the client's network, if any are configured.
+func addAddressFields(networks []options.ClientNetwork, ev *event.Event) {
+	clientIP := addAuthorityFields(ev, "client_authority", "client")
+	addAuthorityFields(ev, "backend_authority", "backend")
+
+	if clientIP == nil || len(networks) == 0 {
+		return
+	}
+	ev.Data[clientNetworkField] = defaultClientNetwork
+	for _, network := range networks {
+		if network.Net.Contains(clientIP) {
+			ev.Data[clientNetworkField] = network.Name
+			break
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package publisher
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestSplitAuthority(t *testing.T) {
+	tests := []struct {
+		authority string
+		ip        string
+		port      int
+		ok        bool
+	}{
+		{"192.0.2.1:54321", "192.0.2.1", 54321, true},
+		{"[2001:db8::1]:443", "2001:db8::1", 443, true},
+		{"2001:db8::1:443", "2001:db8::1", 443, true},
+		{"192.0.2.1", "", 0, false},
+		{"192.0.2.1:http", "", 0, false},
+		{"192.0.2.1:70000", "", 0, false},
+		{"example.com:80", "", 0, false},
+	}
+
+	for _, test := range tests {
+		ip, port, ok := splitAuthority(test.authority)
+		if ok != test.ok {
+			t.Errorf("%s: ok %v, want %v", test.authority, ok, test.ok)
+			continue
+		}
+		if ok && (ip.String() != test.ip || port != test.port) {
+			t.Errorf("%s: got %s and %d, want %s and %d", test.authority, ip, port, test.ip, test.port)
+		}
+	}
+}
+
+func TestAddAddressFields(t *testing.T) {
+	networks, err := options.ParseClientNetworks([]string{
+		"office=203.0.113.0/24",
+		"vpc=10.0.0.0/8",
+		"vpc=2001:db8::/32",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client string
+		want   map[string]interface{}
+	}{
+		{"203.0.113.7:1234", map[string]interface{}{"client_ip": "203.0.113.7", "client_port": 1234, "client_network": "office"}},
+		{"10.1.2.3:1234", map[string]interface{}{"client_ip": "10.1.2.3", "client_port": 1234, "client_network": "vpc"}},
+		{"2001:db8::5:1234", map[string]interface{}{"client_ip": "2001:db8::5", "client_port": 1234, "client_network": "vpc"}},
+		{"198.51.100.1:1234", map[string]interface{}{"client_ip": "198.51.100.1", "client_port": 1234, "client_network": "internet"}},
+	}
+
+	for _, test := range tests {
+		ev := event.Event{Data: map[string]interface{}{
+			"client_authority":  test.client,
+			"backend_authority": "10.0.0.1:8080",
+		}}
+		addAddressFields(networks, &ev)
+
+		test.want["client_authority"] = test.client
+		test.want["backend_authority"] = "10.0.0.1:8080"
+		test.want["backend_ip"] = "10.0.0.1"
+		test.want["backend_port"] = 8080
+		if !reflect.DeepEqual(ev.Data, test.want) {
+			t.Errorf("%s: got %v, want %v", test.client, ev.Data, test.want)
+		}
+	}
+
+	// Without any networks, clients aren't classified.
+	ev := event.Event{Data: map[string]interface{}{"client_authority": "192.0.2.1:1234"}}
+	addAddressFields(nil, &ev)
+	if _, ok := ev.Data[clientNetworkField]; ok {
+		t.Errorf("client_network set without any client networks")
+	}
+}
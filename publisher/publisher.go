@@ -6,8 +6,12 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -21,13 +25,14 @@ import (
 
 const (
 	AWSElasticLoadBalancerFormat = "aws_elb"
+
+	deadLetterFileFormat = "dead-letter-%s.jsonl"
 )
 
 var (
 	// 2017-07-31T20:30:57.975041Z spline_reticulation_lb 10.11.12.13:47882 10.3.47.87:8080 0.000021 0.010962 0.000016 200 200 766 17 "PUT https://api.simulation.io:443/reticulate/spline/1 HTTP/1.1" "libhoney-go/1.3.3" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2
-	logFormat           = []byte(fmt.Sprintf(`log_format %s '$timestamp $elb $client_authority $backend_authority $request_processing_time $backend_processing_time $response_processing_time $elb_status_code $backend_status_code $received_bytes $sent_bytes "$request" "$user_agent" $ssl_cipher $ssl_protocol';`, AWSElasticLoadBalancerFormat))
-	libhoneyInitialized = false
-	formatFileName      string
+	logFormat      = []byte(fmt.Sprintf(`log_format %s '$timestamp $elb $client_authority $backend_authority $request_processing_time $backend_processing_time $response_processing_time $elb_status_code $backend_status_code $received_bytes $sent_bytes "$request" "$user_agent" $ssl_cipher $ssl_protocol';`, AWSElasticLoadBalancerFormat))
+	formatFileName string
 )
 
 func init() {
@@ -48,6 +53,22 @@ func init() {
 	formatFileName = formatFile.Name()
 }
 
+// InitTransmission sets up the libhoney transmission shared by every
+// publisher, and starts handling the responses to the events sent on it. It
+// must be called once, before any events are published. Where events are sent
+// is decided by each publisher's builder, not here.
+func InitTransmission() {
+	libhoney.Init(libhoney.Config{
+		MaxBatchSize:  500,
+		SendFrequency: 100 * time.Millisecond,
+		// Every event's response is needed to know whether it was
+		// delivered, so neither events nor responses may be dropped.
+		BlockOnSend:     true,
+		BlockOnResponse: true,
+	})
+	go handleResponses(libhoney.Responses())
+}
+
 type Publisher interface {
 	// Publish accepts an io.Reader and scans it line-by-line, parses the
 	// relevant event from each line, and sends to the target (Honeycomb)
@@ -59,17 +80,46 @@ type Publisher interface {
 // events to Honeycomb (if desired), as well as isolate line parsing, sampling,
 // and URL sub-parsing logic.
 type HoneycombPublisher struct {
+	// Counts of events sent, retried and given up on over the publisher's
+	// lifetime, updated atomically. These come first to keep them 64-bit
+	// aligned.
+	sent    int64
+	retried int64
+	failed  int64
+
 	APIHost      string
 	SampleRate   int
 	nginxParser  *nginx.Parser
 	lines        chan string
 	eventsToSend chan event.Event
 	sampler      dynsampler.Sampler
+
+	// The target's settings can be updated while events are being
+	// published, so access to them (and the sampler and builder built
+	// from them) is guarded by lock.
+	lock     sync.RWMutex
+	target   options.Target
+	builder  *libhoney.Builder
+	networks []options.ClientNetwork
+
+	// Events which can't be sent are appended to this file as JSON lines.
+	deadLetterFile string
+	deadLetterLock sync.Mutex
+
+	// The sampler's state is snapshotted to this file, to warm it up
+	// with after a restart.
+	samplerStateFile string
 }
 
-func NewHoneycombPublisher(opt *options.Options, logFormatName string) *HoneycombPublisher {
+func NewHoneycombPublisher(opt *options.Options, target options.Target, logFormatName string) *HoneycombPublisher {
 	hp := &HoneycombPublisher{
+		APIHost:     target.APIHost,
+		SampleRate:  target.SampleRate,
 		nginxParser: &nginx.Parser{},
+		target:      target,
+
+		deadLetterFile:   filepath.Join(opt.StateDir, fmt.Sprintf(deadLetterFileFormat, target.LoadBalancer)),
+		samplerStateFile: filepath.Join(opt.StateDir, fmt.Sprintf(samplerStateFileFormat, target.LoadBalancer)),
 	}
 
 	hp.nginxParser.Init(&nginx.Options{
@@ -80,27 +130,83 @@ func NewHoneycombPublisher(opt *options.Options, logFormatName string) *Honeycom
 		NumParsers:      runtime.NumCPU(),
 	})
 
-	if !libhoneyInitialized {
-		libhoney.Init(libhoney.Config{
-			MaxBatchSize:  500,
-			SendFrequency: 100 * time.Millisecond,
-			WriteKey:      opt.WriteKey,
-			Dataset:       opt.Dataset,
-			SampleRate:    uint(opt.SampleRate),
-			APIHost:       opt.APIHost,
-		})
-		libhoneyInitialized = true
+	hp.sampler = hp.newWarmedSampler(target)
+	hp.builder = newBuilder(target)
+	hp.networks = newClientNetworks(target)
+	return hp
+}
+
+// newWarmedSampler builds the target's sampler, warmed up from the snapshot in
+// the sampler state file if that was taken with the same settings.
+func (hp *HoneycombPublisher) newWarmedSampler(target options.Target) dynsampler.Sampler {
+	sampler := newSampler(target)
+	if w, ok := sampler.(*warmSampler); ok {
+		if err := restoreSampler(w, target, hp.samplerStateFile); err != nil {
+			logrus.WithError(err).WithField("lbName", target.LoadBalancer).Warn("Error restoring sampler state, starting cold")
+		}
 	}
+	return sampler
+}
+
+// newBuilder returns a builder for events sent to the target's dataset, in
+// the Honeycomb team its write key belongs to. Events from builders with
+// different write keys or API hosts are batched and sent separately.
+func newBuilder(target options.Target) *libhoney.Builder {
+	builder := libhoney.NewBuilder()
+	builder.APIHost = target.APIHost
+	builder.WriteKey = target.WriteKey
+	builder.Dataset = target.Dataset
+	return builder
+}
 
-	hp.sampler = &dynsampler.AvgSampleRate{
-		ClearFrequencySec: 300,
-		GoalSampleRate:    opt.SampleRate,
+// Update applies new target settings to the events published from now on.
+func (hp *HoneycombPublisher) Update(target options.Target) {
+	hp.lock.Lock()
+	defer hp.lock.Unlock()
+
+	if target.SampleRate != hp.SampleRate || !reflect.DeepEqual(target.Sampler, hp.target.Sampler) {
+		hp.SampleRate = target.SampleRate
+		stopSampler(hp.sampler)
+		hp.sampler = hp.newWarmedSampler(target)
 	}
+	hp.APIHost = target.APIHost
+	hp.target = target
+	hp.builder = newBuilder(target)
+	hp.networks = newClientNetworks(target)
+}
 
-	if err := hp.sampler.Start(); err != nil {
-		logrus.Error(err)
+// newClientNetworks parses the target's client networks. They have already
+// been validated along with the rest of the options.
+func newClientNetworks(target options.Target) []options.ClientNetwork {
+	networks, err := options.ParseClientNetworks(target.ClientNetworks)
+	if err != nil {
+		logrus.WithError(err).WithField("lbName", target.LoadBalancer).Error("Error parsing client networks")
 	}
-	return hp
+	return networks
+}
+
+func (hp *HoneycombPublisher) currentTarget() options.Target {
+	hp.lock.RLock()
+	defer hp.lock.RUnlock()
+	return hp.target
+}
+
+func (hp *HoneycombPublisher) currentBuilder() *libhoney.Builder {
+	hp.lock.RLock()
+	defer hp.lock.RUnlock()
+	return hp.builder
+}
+
+func (hp *HoneycombPublisher) currentNetworks() []options.ClientNetwork {
+	hp.lock.RLock()
+	defer hp.lock.RUnlock()
+	return hp.networks
+}
+
+func (hp *HoneycombPublisher) currentSampler() dynsampler.Sampler {
+	hp.lock.RLock()
+	defer hp.lock.RUnlock()
+	return hp.sampler
 }
 
 type requestShaper struct {
@@ -142,40 +248,64 @@ func (rs *requestShaper) Shape(field string, ev *event.Event) {
 	}
 }
 
-func (h *HoneycombPublisher) dynSample(eventsCh <-chan event.Event, sampledCh chan<- event.Event) {
-	for ev := range eventsCh {
-		// use backend_status_code and elb_status_code to set sample rate
-		var key string
-		if backendStatusCode, ok := ev.Data["backend_status_code"]; ok {
-			if bsc, ok := backendStatusCode.(int64); ok {
-				key = fmt.Sprintf("%d", bsc)
-			} else {
-				key = "0"
-			}
-		}
-		if elbStatusCode, ok := ev.Data["elb_status_code"]; ok {
-			if esc, ok := elbStatusCode.(int64); ok {
-				key = fmt.Sprintf("%s_%d", key, esc)
+// sampleRate decides the rate to sample the event at, according to the
+// target's sampling mode. It returns false if a rule drops the event outright.
+func (h *HoneycombPublisher) sampleRate(target options.Target, ev *event.Event) (int, bool) {
+	switch target.Sampler.Mode {
+	case options.SamplingNone:
+		return 1, true
+	case options.SamplingStatic:
+		return target.SampleRate, true
+	case options.SamplingRules:
+		if rule := matchRule(target.Sampler.Rules, ev); rule != nil {
+			ev.Data[sampleRuleField] = rule.Name
+			switch rule.Action {
+			case options.RuleKeep:
+				return 1, true
+			case options.RuleDrop:
+				return 0, false
+			case options.RuleDynamic:
+			default:
+				return rule.SampleRate, true
 			}
 		}
+	}
 
-		// Make sure sample rate is per-ELB
-		if elbName, ok := ev.Data["elb"]; ok {
-			if name, ok := elbName.(string); ok {
-				key = fmt.Sprintf("%s_%s", key, name)
-			}
-		}
+	key := sampleKey(target.Sampler, ev)
+	return h.currentSampler().GetSampleRate(key), true
+}
 
-		rate := h.sampler.GetSampleRate(key)
+// dynSample is the one place events are sampled. Events are kept with a
+// probability of 1 / their sample rate, and sent on with that rate so that
+// Honeycomb can weight them to reconstruct the true counts. Nothing
+// downstream samples again.
+func (h *HoneycombPublisher) dynSample(eventsCh <-chan event.Event, sampledCh chan<- event.Event) {
+	// Requests are shaped, and latencies, addresses and locations
+	// derived, before sampling, so that they can be part of the sampling key and sampling
+	// rules.
+	shaper := requestShaper{&urlshaper.Parser{}}
+	for ev := range eventsCh {
+		shaper.Shape("request", &ev)
+		deriveLatencyFields(&ev)
+		addAddressFields(h.currentNetworks(), &ev)
+		addGeoIPFields(&ev)
+		target := h.currentTarget()
+
+		rate, ok := h.sampleRate(target, &ev)
+		if !ok {
+			continue
+		}
 		if rate <= 0 {
 			logrus.WithField("rate", rate).Error("Sample should not be less than zero")
 			rate = 1
 		}
+
 		if rand.Intn(rate) == 0 {
 			ev.SampleRate = rate
 			sampledCh <- ev
 		}
 	}
+	close(sampledCh)
 }
 
 func (h *HoneycombPublisher) sample(eventsCh <-chan event.Event) chan event.Event {
@@ -184,52 +314,60 @@ func (h *HoneycombPublisher) sample(eventsCh <-chan event.Event) chan event.Even
 	return sampledCh
 }
 
-func dropNegativeTimes(ev *event.Event) {
-	timeFields := []string{
-		"response_processing_time",
-		"request_processing_time",
-		"backend_processing_time",
-	}
-	for _, f := range timeFields {
-		if t, present := ev.Data[f]; present {
-			if tfloat, isFloat := t.(float64); isFloat && tfloat < 0 {
-				delete(ev.Data, f)
-			}
+// transform applies the configured field transforms: renames first, then
+// drops, then additions.
+func transform(transforms options.Transforms, ev *event.Event) {
+	for from, to := range transforms.Rename {
+		if val, ok := ev.Data[from]; ok {
+			delete(ev.Data, from)
+			ev.Data[to] = val
 		}
 	}
+	for _, f := range transforms.Drop {
+		delete(ev.Data, f)
+	}
+	for f, val := range transforms.Add {
+		ev.Data[f] = val
+	}
 }
 
-func sendEvents(eventsCh <-chan event.Event) {
-	shaper := requestShaper{&urlshaper.Parser{}}
+func (h *HoneycombPublisher) sendEvents(eventsCh <-chan event.Event, d *delivery) {
 	for ev := range eventsCh {
-		shaper.Shape("request", &ev)
-		libhEv := libhoney.NewEvent()
-		libhEv.Timestamp = ev.Timestamp
-		libhEv.SampleRate = uint(ev.SampleRate)
-		dropNegativeTimes(&ev)
-		if err := libhEv.Add(ev.Data); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"event": ev,
-				"error": err,
-			}).Error("Unexpected error adding data to libhoney event")
-		}
-		// sampling is handled by the nginx parser
-		if err := libhEv.SendPresampled(); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"event": ev,
-				"error": err,
-			}).Error("Unexpected error event to libhoney send")
+		target := h.currentTarget()
+		transform(target.Transforms, &ev)
+
+		d.wg.Add(1)
+		p := &pendingEvent{
+			delivery:   d,
+			builder:    h.currentBuilder(),
+			timestamp:  ev.Timestamp,
+			sampleRate: uint(ev.SampleRate),
+			data:       ev.Data,
 		}
+		p.send()
 	}
 }
 
+// Publish returns once every event from r has been delivered to Honeycomb, or
+// given up on. It returns an error if any were given up on, so that the caller
+// doesn't consider them sent.
 func (hp *HoneycombPublisher) Publish(r io.Reader) error {
 	linesCh := make(chan string, runtime.NumCPU())
 	eventsCh := make(chan event.Event, runtime.NumCPU())
 	scanner := bufio.NewScanner(r)
-	go hp.nginxParser.ProcessLines(linesCh, eventsCh, nil)
+	go func() {
+		hp.nginxParser.ProcessLines(linesCh, eventsCh, nil)
+		close(eventsCh)
+	}()
 	sampledCh := hp.sample(eventsCh)
-	go sendEvents(sampledCh)
+
+	d := &delivery{hp: hp}
+	sendDone := make(chan struct{})
+	go func() {
+		hp.sendEvents(sampledCh, d)
+		close(sendDone)
+	}()
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
@@ -237,8 +375,37 @@ func (hp *HoneycombPublisher) Publish(r io.Reader) error {
 		}
 		linesCh <- line
 	}
+	close(linesCh)
+
+	<-sendDone
+	d.wg.Wait()
+
+	logrus.WithFields(logrus.Fields{
+		"sent":          d.sent,
+		"retried":       d.retried,
+		"failed":        d.failed,
+		"total_sent":    atomic.LoadInt64(&hp.sent),
+		"total_retried": atomic.LoadInt64(&hp.retried),
+		"total_failed":  atomic.LoadInt64(&hp.failed),
+		"lbName":        hp.currentTarget().LoadBalancer,
+	}).Info("Finished sending events")
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if d.failed > 0 {
+		return fmt.Errorf("%d events could not be sent, see %s", d.failed, hp.deadLetterFile)
+	}
+
+	return nil
+}
 
-	return scanner.Err()
+// Stop stops the publisher's sampler. The publisher can't be used once it has
+// been stopped.
+func (hp *HoneycombPublisher) Stop() {
+	hp.lock.Lock()
+	defer hp.lock.Unlock()
+	stopSampler(hp.sampler)
 }
 
 // Close flushes outstanding sends
@@ -0,0 +1,88 @@
+package publisher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// sampleRuleField is added to every event which matched a sampling rule, set
+// to the name of the rule.
+const sampleRuleField = "sample_rule"
+
+// matchRule returns the first of the rules which the event matches, or nil if
+// it matches none of them.
+func matchRule(rules []options.SamplingRule, ev *event.Event) *options.SamplingRule {
+	for i := range rules {
+		matched := true
+		for _, cond := range rules[i].Conditions {
+			if !conditionMatches(cond, ev.Data) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func conditionMatches(cond options.Condition, data map[string]interface{}) bool {
+	val, ok := data[cond.Field]
+	if cond.Op == "exists" || !ok {
+		return ok
+	}
+
+	switch cond.Op {
+	case "=", "!=":
+		// Compare numerically if possible, so that 200 matches 200.0.
+		a, aIsNum := toFloat(val)
+		b, bIsNum := toFloat(cond.Value)
+		equal := fmt.Sprint(val) == fmt.Sprint(cond.Value)
+		if aIsNum && bIsNum {
+			equal = a == b
+		}
+		return equal == (cond.Op == "=")
+	case ">", ">=", "<", "<=":
+		a, aIsNum := toFloat(val)
+		b, bIsNum := toFloat(cond.Value)
+		if !aIsNum || !bIsNum {
+			return false
+		}
+		switch cond.Op {
+		case ">":
+			return a > b
+		case ">=":
+			return a >= b
+		case "<":
+			return a < b
+		default:
+			return a <= b
+		}
+	case "prefix":
+		s, isString := val.(string)
+		return isString && strings.HasPrefix(s, fmt.Sprint(cond.Value))
+	case "contains":
+		s, isString := val.(string)
+		return isString && strings.Contains(s, fmt.Sprint(cond.Value))
+	}
+
+	return false
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
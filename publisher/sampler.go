@@ -0,0 +1,117 @@
+package publisher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// newSampler builds and starts the dynamic sampler configured for the target.
+func newSampler(target options.Target) dynsampler.Sampler {
+	switch target.Sampler.Mode {
+	case options.SamplingNone, options.SamplingStatic:
+		// The dynamic sampler isn't used.
+		return &dynsampler.Static{Default: target.SampleRate}
+	}
+
+	clearFrequencySec := int(target.Sampler.ClearFrequency / time.Second)
+
+	var sampler dynsampler.Sampler
+	switch target.Sampler.Type {
+	case options.SamplerAvgSampleWithMin:
+		sampler = &dynsampler.AvgSampleWithMin{
+			ClearFrequencySec: clearFrequencySec,
+			GoalSampleRate:    target.SampleRate,
+			MinEventsPerSec:   target.Sampler.MinEventsPerSec,
+		}
+	case options.SamplerPerKeyThroughput:
+		sampler = &dynsampler.PerKeyThroughput{
+			ClearFrequencySec:      clearFrequencySec,
+			PerKeyThroughputPerSec: target.Sampler.PerKeyThroughput,
+		}
+	case options.SamplerTotalThroughput:
+		sampler = &dynsampler.TotalThroughput{
+			ClearFrequencySec:    clearFrequencySec,
+			GoalThroughputPerSec: target.Sampler.GoalThroughput,
+		}
+	case options.SamplerOnlyOnce:
+		sampler = &dynsampler.OnlyOnce{
+			ClearFrequencySec: clearFrequencySec,
+		}
+	case options.SamplerStatic:
+		sampler = &dynsampler.Static{
+			Rates:   target.Sampler.Rates,
+			Default: target.SampleRate,
+		}
+	default:
+		sampler = &dynsampler.AvgSampleRate{
+			ClearFrequencySec: clearFrequencySec,
+			GoalSampleRate:    target.SampleRate,
+		}
+	}
+
+	if err := sampler.Start(); err != nil {
+		logrus.Error(err)
+	}
+
+	switch target.Sampler.Type {
+	case options.SamplerStatic:
+		// Nothing to warm up.
+		return sampler
+	}
+	return newWarmSampler(sampler, target.Sampler.ClearFrequency)
+}
+
+// stopSampler stops a sampler which is being replaced, so that its background
+// work doesn't carry on forever.
+func stopSampler(sampler dynsampler.Sampler) {
+	if err := sampler.Stop(); err != nil {
+		logrus.WithError(err).Error("Error stopping sampler")
+	}
+}
+
+// latencyBucketField is a sample key field derived from the event's total
+// latency, rather than taken from the event itself.
+const latencyBucketField = "latency_bucket"
+
+// sampleKey joins the values of the event's key fields into the key its
+// sample rate is looked up by. Missing fields are left empty, so that every
+// key has the same number of parts.
+func sampleKey(sampler options.Sampler, ev *event.Event) string {
+	parts := make([]string, len(sampler.KeyFields))
+	for i, field := range sampler.KeyFields {
+		if val, ok := ev.Data[field]; ok {
+			parts[i] = fmt.Sprint(val)
+		} else if field == latencyBucketField {
+			parts[i] = latencyBucket(sampler.LatencyBuckets, ev)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// latencyBucket names the bucket the event's total latency falls in, e.g.,
+// "<100ms", "100ms-500ms" or ">=5s", given the boundaries between buckets in
+// ascending order. The total is the event's duration_ms, which leaves out the
+// processing times the load balancer couldn't measure.
+func latencyBucket(boundaries []time.Duration, ev *event.Event) string {
+	ms, measured := ev.Data[durationField].(float64)
+	if !measured || len(boundaries) == 0 {
+		return ""
+	}
+
+	latency := time.Duration(ms * float64(time.Millisecond))
+	if latency < boundaries[0] {
+		return "<" + boundaries[0].String()
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if latency < boundaries[i] {
+			return boundaries[i-1].String() + "-" + boundaries[i].String()
+		}
+	}
+	return ">=" + boundaries[len(boundaries)-1].String()
+}
@@ -0,0 +1,243 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeyelb/statedir"
+)
+
+const (
+	samplerStateFileFormat = "sampler-%s.json"
+
+	// Snapshots older than this are ignored, since traffic will have
+	// changed too much since for them to be any better than starting
+	// cold.
+	maxSamplerStateAge = time.Hour
+
+	// What dynsampler-go uses when no clear frequency is set.
+	defaultClearFrequency = 30 * time.Second
+
+	// At most this many of a snapshot's counted events are fed to the
+	// restored sampler, scaled down proportionally, so that restoring the
+	// sampler of a busy load balancer doesn't hold up starting it.
+	maxRestoredEvents = 10000
+)
+
+// samplerState is a snapshot of a sampler, kept in the state directory so that
+// sampling can pick up where it left off after a restart.
+type samplerState struct {
+	Saved      time.Time `json:"saved"`
+	SampleRate int       `json:"samplerate"`
+
+	// The sampler's settings, as JSON, to check that they haven't
+	// changed since the snapshot.
+	Sampler json.RawMessage `json:"sampler"`
+
+	// The latest sample rate of each key, and how many events each key
+	// has had in the current interval.
+	Rates  map[string]int `json:"rates"`
+	Counts map[string]int `json:"counts"`
+}
+
+// warmSampler wraps a dynamic sampler, keeping track of its per-key rates and
+// counts so that they can be snapshotted, and so that a new sampler can be
+// warmed up from a snapshot. dynsampler-go samplers have no way of saving or
+// restoring their state themselves.
+type warmSampler struct {
+	dynsampler.Sampler
+	clearFrequency time.Duration
+
+	lock          sync.Mutex
+	started       time.Time
+	intervalStart time.Time
+	prevRates     map[string]int
+	rates         map[string]int
+	counts        map[string]int
+
+	// Rates restored from a snapshot, used until the sampler has had a
+	// full interval to calculate its own.
+	restored map[string]int
+}
+
+func newWarmSampler(sampler dynsampler.Sampler, clearFrequency time.Duration) *warmSampler {
+	if clearFrequency <= 0 {
+		clearFrequency = defaultClearFrequency
+	}
+	now := time.Now()
+	return &warmSampler{
+		Sampler:        sampler,
+		clearFrequency: clearFrequency,
+		started:        now,
+		intervalStart:  now,
+		prevRates:      make(map[string]int),
+		rates:          make(map[string]int),
+		counts:         make(map[string]int),
+	}
+}
+
+func (w *warmSampler) GetSampleRate(key string) int {
+	rate := w.Sampler.GetSampleRate(key)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.intervalStart) >= w.clearFrequency {
+		w.intervalStart = now
+		w.prevRates = w.rates
+		w.rates = make(map[string]int)
+		w.counts = make(map[string]int)
+	}
+
+	if w.restored != nil {
+		if now.Sub(w.started) >= w.clearFrequency {
+			w.restored = nil
+		} else if restoredRate, ok := w.restored[key]; ok {
+			rate = restoredRate
+		}
+	}
+
+	w.counts[key]++
+	w.rates[key] = rate
+	return rate
+}
+
+func (w *warmSampler) snapshot(target options.Target) (samplerState, error) {
+	settings, err := json.Marshal(target.Sampler)
+	if err != nil {
+		return samplerState{}, fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	state := samplerState{
+		Saved:      time.Now().UTC(),
+		Sampler:    settings,
+		SampleRate: target.SampleRate,
+		Rates:      make(map[string]int, len(w.prevRates)+len(w.rates)),
+		Counts:     make(map[string]int, len(w.counts)),
+	}
+	for key, rate := range w.prevRates {
+		state.Rates[key] = rate
+	}
+	for key, rate := range w.rates {
+		state.Rates[key] = rate
+	}
+	for key, count := range w.counts {
+		state.Counts[key] = count
+	}
+	return state, nil
+}
+
+// restore warms the sampler up from a snapshot: the snapshot's rates are used
+// for the first interval, and its counts (scaled down to maxRestoredEvents in
+// total) are fed to the sampler so that they count towards the rates it
+// calculates at the end of that interval.
+func (w *warmSampler) restore(state samplerState) {
+	for key, count := range scaleCounts(state.Counts, maxRestoredEvents) {
+		for i := 0; i < count; i++ {
+			w.Sampler.GetSampleRate(key)
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.restored = state.Rates
+	for key, count := range state.Counts {
+		w.counts[key] += count
+	}
+}
+
+// scaleCounts scales the counts down proportionally so that they add up to no
+// more than max, keeping at least one of each key.
+func scaleCounts(counts map[string]int, max int) map[string]int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total <= max {
+		return counts
+	}
+
+	scaled := make(map[string]int, len(counts))
+	for key, count := range counts {
+		scaled[key] = count * max / total
+		if scaled[key] == 0 {
+			scaled[key] = 1
+		}
+	}
+	return scaled
+}
+
+// restoreSampler warms the sampler up from the snapshot in the state file, if
+// there is one which is recent enough and was taken of a sampler with the same
+// settings.
+func restoreSampler(w *warmSampler, target options.Target, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading sampler state file: %s", err)
+	}
+
+	var state samplerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("Unmarshalling sampler state file JSON failed: %s", err)
+	}
+
+	settings, err := json.Marshal(target.Sampler)
+	if err != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+
+	if time.Since(state.Saved) > maxSamplerStateAge ||
+		state.SampleRate != target.SampleRate ||
+		!bytes.Equal(state.Sampler, settings) {
+		return nil
+	}
+
+	w.restore(state)
+	return nil
+}
+
+// SaveSamplerState snapshots the publisher's sampler to its state file, so
+// that it can be restored after a restart. A sampler which hasn't sampled
+// anything yet has nothing worth saving, so the previous snapshot is left be.
+func (hp *HoneycombPublisher) SaveSamplerState() error {
+	hp.lock.RLock()
+	w, isWarm := hp.sampler.(*warmSampler)
+	target := hp.target
+	hp.lock.RUnlock()
+	if !isWarm {
+		return nil
+	}
+
+	state, err := w.snapshot(target)
+	if err != nil {
+		return err
+	}
+	if len(state.Rates) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Marshalling JSON failed: %s", err)
+	}
+
+	if err := statedir.WriteFile(hp.samplerStateFile, data, 0644); err != nil {
+		return fmt.Errorf("Writing sampler state file failed: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyelb/options"
+)
+
+// countingSampler counts how often each key's sample rate is asked for.
+type countingSampler map[string]int
+
+func (s countingSampler) Start() error { return nil }
+
+func (s countingSampler) Stop() error { return nil }
+
+func (s countingSampler) GetSampleRate(key string) int {
+	s[key]++
+	return 1
+}
+
+func stateTestPublisher(dir string, target options.Target) *HoneycombPublisher {
+	hp := &HoneycombPublisher{
+		SampleRate:       target.SampleRate,
+		target:           target,
+		samplerStateFile: filepath.Join(dir, "sampler-test-lb.json"),
+	}
+	hp.sampler = hp.newWarmedSampler(target)
+	return hp
+}
+
+func stateTestTarget(clearFrequency time.Duration) options.Target {
+	return testTarget(options.Sampler{
+		Mode:           options.SamplingDynamic,
+		ClearFrequency: clearFrequency,
+	})
+}
+
+// savedState sets up a state file in a new directory, snapshotted from a
+// sampler which picked rates of 7 and 3 for keys a and b.
+func savedState(t *testing.T, target options.Target) string {
+	dir, err := ioutil.TempDir("", "samplerstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hp := stateTestPublisher(dir, target)
+	w := hp.sampler.(*warmSampler)
+	w.Sampler = fixedSampler{"a": 7, "b": 3}
+	for i := 0; i < 5; i++ {
+		w.GetSampleRate("a")
+	}
+	w.GetSampleRate("b")
+
+	if err := hp.SaveSamplerState(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSamplerStateRestored(t *testing.T) {
+	target := stateTestTarget(time.Minute)
+	dir := savedState(t, target)
+	defer os.RemoveAll(dir)
+
+	w := stateTestPublisher(dir, target).sampler.(*warmSampler)
+	for key, want := range map[string]int{"a": 7, "b": 3} {
+		if rate := w.GetSampleRate(key); rate != want {
+			t.Errorf("%s: sample rate %d, want the restored %d", key, rate, want)
+		}
+	}
+	if w.counts["a"] != 6 {
+		t.Errorf("a: count %d, want 5 restored and 1 new", w.counts["a"])
+	}
+}
+
+func TestSamplerStateIgnoredForOtherSettings(t *testing.T) {
+	target := stateTestTarget(time.Minute)
+	dir := savedState(t, target)
+	defer os.RemoveAll(dir)
+
+	w := stateTestPublisher(dir, stateTestTarget(2*time.Minute)).sampler.(*warmSampler)
+	if w.restored != nil {
+		t.Errorf("restored %v from a snapshot with different settings", w.restored)
+	}
+}
+
+func TestSamplerStateIgnoredWhenStale(t *testing.T) {
+	target := stateTestTarget(time.Minute)
+	dir := savedState(t, target)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sampler-test-lb.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state samplerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.Saved = state.Saved.Add(-2 * maxSamplerStateAge)
+	data, _ = json.Marshal(state)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := stateTestPublisher(dir, target).sampler.(*warmSampler)
+	if w.restored != nil {
+		t.Errorf("restored %v from a stale snapshot", w.restored)
+	}
+}
+
+func TestSamplerStateNotOverwrittenByColdSampler(t *testing.T) {
+	target := stateTestTarget(time.Minute)
+	dir := savedState(t, target)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sampler-test-lb.json")
+	before, _ := ioutil.ReadFile(path)
+
+	// A sampler with other settings starts cold, and hasn't sampled
+	// anything by the time it's saved.
+	hp := stateTestPublisher(dir, stateTestTarget(2*time.Minute))
+	if err := hp.SaveSamplerState(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(before, after) {
+		t.Errorf("snapshot overwritten by a cold sampler: %s", after)
+	}
+}
+
+func TestSamplerStateRestoredOnUpdate(t *testing.T) {
+	target := stateTestTarget(time.Minute)
+	dir := savedState(t, target)
+	defer os.RemoveAll(dir)
+
+	hp := stateTestPublisher(dir, stateTestTarget(2*time.Minute))
+	hp.Update(target)
+
+	w := hp.currentSampler().(*warmSampler)
+	if rate := w.GetSampleRate("a"); rate != 7 {
+		t.Errorf("sample rate %d after update, want the restored 7", rate)
+	}
+}
+
+func TestSamplerRestoreScalesCounts(t *testing.T) {
+	counter := countingSampler{}
+	w := newWarmSampler(counter, time.Minute)
+	w.restore(samplerState{Counts: map[string]int{
+		"busy":  1000000,
+		"quiet": 10000,
+		"rare":  1,
+	}})
+
+	want := map[string]int{"busy": 9900, "quiet": 99, "rare": 1}
+	for key, count := range want {
+		if counter[key] != count {
+			t.Errorf("%s: fed %d events to the sampler, want %d", key, counter[key], count)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package publisher
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeyelb/options"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// How many standard errors the counts reconstructed from sample rates may be
+// from the true counts.
+const countTolerance = 4
+
+// fixedSampler is a dynamic sampler which always picks the same rate for a
+// key, so that tests don't have to wait for a real one to settle.
+type fixedSampler map[string]int
+
+func (s fixedSampler) Start() error { return nil }
+
+func (s fixedSampler) Stop() error { return nil }
+
+func (s fixedSampler) GetSampleRate(key string) int {
+	if rate, ok := s[key]; ok {
+		return rate
+	}
+	return 1
+}
+
+func testTarget(sampler options.Sampler) options.Target {
+	sampler.KeyFields = []string{"elb_status_code"}
+	if sampler.Type == "" {
+		sampler.Type = options.SamplerAvgSampleRate
+	}
+	return options.Target{
+		LoadBalancer: "test-lb",
+		SampleRate:   10,
+		Sampler:      sampler,
+	}
+}
+
+func testPublisher(target options.Target) *HoneycombPublisher {
+	return &HoneycombPublisher{
+		SampleRate: target.SampleRate,
+		target:     target,
+		sampler:    newSampler(target),
+	}
+}
+
+// trueCounts is how many events with each status code are sampled.
+var trueCounts = map[int]int{
+	200: 100000,
+	404: 20000,
+	500: 5000,
+}
+
+// sampleEvents samples trueCounts' events and returns those kept.
+func sampleEvents(hp *HoneycombPublisher) []event.Event {
+	eventsCh := make(chan event.Event)
+	sampledCh := hp.sample(eventsCh)
+
+	go func() {
+		for _, status := range []int{200, 404, 500} {
+			for j := 0; j < trueCounts[status]; j++ {
+				eventsCh <- event.Event{
+					Timestamp: time.Now(),
+					Data:      map[string]interface{}{"elb_status_code": status},
+				}
+			}
+		}
+		close(eventsCh)
+	}()
+
+	kept := []event.Event{}
+	for ev := range sampledCh {
+		kept = append(kept, ev)
+	}
+	return kept
+}
+
+// assertCountsReconstructed checks that the counts reconstructed from the
+// kept events are within the tolerance of the true counts. Each kept event
+// with sample rate r contributes r*(r-1) to the estimated variance of its
+// count, so keys sampled at a rate of 1 must be exact.
+func assertCountsReconstructed(t *testing.T, kept []event.Event, want map[int]int) {
+	t.Helper()
+	counts := make(map[int]int)
+	variances := make(map[int]float64)
+	for _, ev := range kept {
+		status := ev.Data["elb_status_code"].(int)
+		counts[status] += ev.SampleRate
+		variances[status] += float64(ev.SampleRate * (ev.SampleRate - 1))
+	}
+
+	for status, wantCount := range want {
+		got := counts[status]
+		if diff := math.Abs(float64(got - wantCount)); diff > countTolerance*math.Sqrt(variances[status]) {
+			t.Errorf("status %d: reconstructed count %d, want %d (within %d standard errors of %.0f)", status, got, wantCount, countTolerance, math.Sqrt(variances[status]))
+		}
+	}
+	for status, got := range counts {
+		if _, ok := want[status]; !ok {
+			t.Errorf("status %d: reconstructed count %d, want none", status, got)
+		}
+	}
+}
+
+func TestSamplingNoneSendsEverything(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{Mode: options.SamplingNone}))
+
+	kept := sampleEvents(hp)
+	for _, ev := range kept {
+		if ev.SampleRate != 1 {
+			t.Fatalf("sample rate %d, want 1", ev.SampleRate)
+		}
+	}
+	assertCountsReconstructed(t, kept, trueCounts)
+}
+
+func TestSamplingStaticReconstructsCounts(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{Mode: options.SamplingStatic}))
+
+	kept := sampleEvents(hp)
+	for _, ev := range kept {
+		if ev.SampleRate != 10 {
+			t.Fatalf("sample rate %d, want 10", ev.SampleRate)
+		}
+	}
+	assertCountsReconstructed(t, kept, trueCounts)
+}
+
+func TestSamplingDynamicReconstructsCounts(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{Mode: options.SamplingDynamic}))
+	hp.sampler = fixedSampler{"200": 50, "404": 5, "500": 1}
+
+	kept := sampleEvents(hp)
+	assertCountsReconstructed(t, kept, trueCounts)
+}
+
+func TestSamplingDynamicStaticSamplerReconstructsCounts(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{
+		Mode:  options.SamplingDynamic,
+		Type:  options.SamplerStatic,
+		Rates: map[string]int{"200": 100, "500": 1},
+	}))
+
+	kept := sampleEvents(hp)
+	assertCountsReconstructed(t, kept, trueCounts)
+}
+
+func TestSamplingDynamicIgnoresRules(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{
+		Mode: options.SamplingDynamic,
+		Rules: []options.SamplingRule{
+			{Name: "no-404s", Conditions: []options.Condition{{Field: "elb_status_code", Op: "=", Value: 404}}, Action: options.RuleDrop},
+		},
+	}))
+	hp.sampler = fixedSampler{"200": 50, "404": 5, "500": 1}
+
+	kept := sampleEvents(hp)
+	for _, ev := range kept {
+		if _, ok := ev.Data[sampleRuleField]; ok {
+			t.Fatalf("event has %s set in dynamic mode", sampleRuleField)
+		}
+	}
+	assertCountsReconstructed(t, kept, trueCounts)
+}
+
+func TestSamplingRulesReconstructsCounts(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{
+		Mode: options.SamplingRules,
+		Rules: []options.SamplingRule{
+			{Name: "errors", Conditions: []options.Condition{{Field: "elb_status_code", Op: ">=", Value: 500}}, Action: options.RuleKeep},
+			{Name: "no-404s", Conditions: []options.Condition{{Field: "elb_status_code", Op: "=", Value: 404}}, Action: options.RuleDrop},
+			{Name: "ok", Conditions: []options.Condition{{Field: "elb_status_code", Op: "=", Value: 200}}, SampleRate: 20},
+		},
+	}))
+
+	kept := sampleEvents(hp)
+	for _, ev := range kept {
+		status := ev.Data["elb_status_code"].(int)
+		rule := ev.Data[sampleRuleField]
+		switch {
+		case status == 500 && (rule != "errors" || ev.SampleRate != 1):
+			t.Fatalf("500: rule %v at rate %d, want errors at 1", rule, ev.SampleRate)
+		case status == 200 && (rule != "ok" || ev.SampleRate != 20):
+			t.Fatalf("200: rule %v at rate %d, want ok at 20", rule, ev.SampleRate)
+		}
+	}
+
+	// Dropped events can't be reconstructed, so they mustn't be sent.
+	assertCountsReconstructed(t, kept, map[int]int{
+		200: trueCounts[200],
+		500: trueCounts[500],
+	})
+}
+
+func TestSamplingRulesFallsBackToDynamic(t *testing.T) {
+	hp := testPublisher(testTarget(options.Sampler{
+		Mode: options.SamplingRules,
+		Rules: []options.SamplingRule{
+			{Name: "errors", Conditions: []options.Condition{{Field: "elb_status_code", Op: ">=", Value: 500}}, Action: options.RuleKeep},
+			{Name: "not-found", Conditions: []options.Condition{{Field: "elb_status_code", Op: "=", Value: 404}}, Action: options.RuleDynamic},
+		},
+	}))
+	hp.sampler = fixedSampler{"200": 50, "404": 5, "500": 1000}
+
+	kept := sampleEvents(hp)
+	for _, ev := range kept {
+		if ev.Data["elb_status_code"] == 500 && ev.SampleRate != 1 {
+			t.Fatalf("500 sampled at rate %d, want the keep rule's 1", ev.SampleRate)
+		}
+	}
+	assertCountsReconstructed(t, kept, trueCounts)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/honeycombio/honeyelb/logbucket"
+	"github.com/honeycombio/honeyelb/publisher"
+	"github.com/honeycombio/honeyelb/statedir"
+)
+
+// cmdReplay reprocesses the objects which failed to be ingested for the named
+// load balancers, or all of those with state in --statedir if none are named.
+func cmdReplay(sess *session.Session, lbNames []string) error {
+	if len(lbNames) == 0 {
+		var err error
+		lbNames, err = logbucket.StateEntities(opt.StateDir, logbucket.AWSElasticLoadBalancing)
+		if err != nil {
+			return fmt.Errorf("Error finding state files: %s", err)
+		}
+	}
+
+	// Replaying while 'honeyelb ingest' is running would have them both
+	// updating the same state files.
+	unlock, err := statedir.Lock(opt.StateDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	publisher.InitTransmission()
+	if err := publisher.InitGeoIP(opt.GeoIPDB, opt.ASNDB, opt.GeoIPCacheSize); err != nil {
+		return err
+	}
+
+	stillFailed := 0
+	for _, lbName := range lbNames {
+		target := opt.Target(lbName)
+		if target.WriteKey == "" {
+			return fmt.Errorf("No write key set for load balancer %q, set --writekey or a writekey for its target in the config file", lbName)
+		}
+
+		hp := publisher.NewHoneycombPublisher(opt, target, publisher.AWSElasticLoadBalancerFormat)
+		downloadParser := logbucket.ObjectDownloadParser{
+			Service:            logbucket.AWSElasticLoadBalancing,
+			Entity:             lbName,
+			HoneycombPublisher: hp,
+			StateDir:           opt.StateDir,
+			BackfillInterval:   target.Backfill,
+			UseTempFiles:       opt.TempFiles,
+		}
+
+		n, err := downloadParser.Replay(context.Background(), sess)
+		hp.Stop()
+		if err != nil {
+			return err
+		}
+		stillFailed += n
+	}
+
+	if stillFailed > 0 {
+		return fmt.Errorf("%d objects still could not be processed", stillFailed)
+	}
+
+	logrus.Info("Replayed all failed objects")
+	return nil
+}
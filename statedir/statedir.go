@@ -0,0 +1,62 @@
+// Package statedir looks after the state directory, which more than one
+// honeyelb command can be pointed at.
+package statedir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const lockFileName = "honeyelb.lock"
+
+// Lock takes an exclusive lock on the state directory, so that only one
+// honeyelb at a time (e.g., `ingest` or `replay`) updates the state files in
+// it. It fails straight away if another process holds the lock. The lock is
+// released by calling the returned function, or when the process exits.
+func Lock(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening state directory lock file: %s", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("Another honeyelb is using the state directory %s, stop it first", dir)
+		}
+		return nil, fmt.Errorf("Error locking state directory: %s", err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// WriteFile writes the data to a temporary file next to path, then renames it
+// into place, so that the file is never left half written.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// A no-op once the file has been renamed.
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
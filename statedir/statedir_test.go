@@ -0,0 +1,59 @@
+package statedir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeyelb-statedir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unlock, err := Lock(dir)
+	if err != nil {
+		t.Fatalf("locking: %s", err)
+	}
+	if _, err := Lock(dir); err == nil {
+		t.Fatal("locked the state directory twice, want an error")
+	}
+
+	unlock()
+	unlock, err = Lock(dir)
+	if err != nil {
+		t.Fatalf("locking after unlocking: %s", err)
+	}
+	unlock()
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeyelb-statedir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	for _, data := range []string{`{"processed":["a","b"]}`, `{}`} {
+		if err := WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("writing: %s", err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("got %q, want %q", got, data)
+		}
+	}
+
+	// Only the file itself is left behind.
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(paths) != 1 {
+		t.Errorf("files left in the state directory: %v", paths)
+	}
+}